@@ -0,0 +1,300 @@
+// Package client calls the JSON API and the downloads of a megalink server, it is described
+// by the OpenAPI document the server serves at /api/openapi.json
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	// client of the requests, e.g. with a TLS client certificate, default http.DefaultClient
+	HTTPClient *http.Client
+	// static token or API key secret, sent as bearer token
+	Token string
+	// credentials of HTTP basic auth, used when Token is empty
+	Username, Password string
+}
+
+type Client struct {
+	base *url.URL
+	opts Options
+}
+
+// New returns a client of the server at baseURL, which includes the base path of the server
+// if any, e.g. https://tools.example.com/megalink
+func New(baseURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid base URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("base URL %q must be an http or https URL", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	return &Client{base: u, opts: opts}, nil
+}
+
+// Error is a response with an error status
+type Error struct {
+	StatusCode int
+	// public message of the server, empty if it sent none
+	Message string
+	// wait asked for by Retry-After, e.g. of rate limits
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("megalink: %d %s", e.StatusCode, msg)
+}
+
+// StatusCode returns the status of an *Error, 0 for other errors
+func StatusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// newError reads the message of an error response, the JSON API answers {"error": msg},
+// the download routes plain text
+func newError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	var v struct {
+		Error string `json:"error"`
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &v) == nil {
+		e.Message = v.Error
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+// url returns the URL of path, which must be escaped already
+func (c *Client) url(path string) string {
+	return c.base.String() + path
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, in interface{}) (*http.Request, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, errorx.Decorate(err, "encode json failed")
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return nil, errorx.Decorate(err, "create request failed")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	} else if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	return req, nil
+}
+
+// call sends in as JSON body if not nil, and decodes the response into out if not nil,
+// any status but want is an *Error
+func (c *Client) call(ctx context.Context, method, path string, in, out interface{}, want int) error {
+	req, err := c.newRequest(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		return newError(resp)
+	}
+	if out != nil {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return errorx.Decorate(err, "decode json failed")
+		}
+	}
+	return nil
+}
+
+// Ready tells whether the server is up and reaches the MEGA api
+func (c *Client) Ready(ctx context.Context) error {
+	return c.call(ctx, http.MethodGet, "/readyz", nil, nil, http.StatusOK)
+}
+
+type SignRequest struct {
+	// MEGA URL of a file, or of a file inside a folder
+	Link string `json:"link"`
+	// seconds until expiry, 0 for the server default, -1 for never
+	TTL int64 `json:"ttl,omitempty"`
+	// copies of the file the link allows, downloads of disjoint parts share a use, 0 for unlimited
+	MaxUses int `json:"max_uses,omitempty"`
+	// only the client signing the link may use it
+	BindIP bool `json:"bind_ip,omitempty"`
+	// filename appended to the link URL
+	Filename string `json:"filename,omitempty"`
+}
+
+type SignedLink struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+	// unix time, 0 for never
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Sign issues a signed link, pass its Token to Signed to download it
+func (c *Client) Sign(ctx context.Context, req SignRequest) (*SignedLink, error) {
+	var link SignedLink
+	if err := c.call(ctx, http.MethodPost, "/api/sign", req, &link, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (c *Client) Aliases(ctx context.Context) ([]alias.Entry, error) {
+	var list []alias.Entry
+	if err := c.call(ctx, http.MethodGet, "/api/aliases", nil, &list, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Client) Alias(ctx context.Context, name string) (*alias.Entry, error) {
+	var e alias.Entry
+	if err := c.call(ctx, http.MethodGet, "/api/aliases/"+url.PathEscape(name), nil, &e, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// SetAlias points name to link, a MEGA URL of a file, a folder or a file inside a folder, admin only
+func (c *Client) SetAlias(ctx context.Context, name, link string) (*alias.Entry, error) {
+	var e alias.Entry
+	req := struct {
+		Link string `json:"link"`
+	}{link}
+	if err := c.call(ctx, http.MethodPut, "/api/aliases/"+url.PathEscape(name), req, &e, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// DeleteAlias removes an alias, admin only
+func (c *Client) DeleteAlias(ctx context.Context, name string) error {
+	return c.call(ctx, http.MethodDelete, "/api/aliases/"+url.PathEscape(name), nil, nil, http.StatusNoContent)
+}
+
+type Throttle struct {
+	throttle.Limits
+	// where the limits come from: default, schedule or override
+	Source string `json:"source"`
+}
+
+// Throttle returns the bandwidth limits in effect, admin only
+func (c *Client) Throttle(ctx context.Context) (*Throttle, error) {
+	return c.throttle(ctx, http.MethodGet, nil)
+}
+
+// SetThrottle overrides the default and scheduled bandwidth limits until ResetThrottle, admin only
+func (c *Client) SetThrottle(ctx context.Context, l throttle.Limits) (*Throttle, error) {
+	return c.throttle(ctx, http.MethodPut, l)
+}
+
+// ResetThrottle goes back to the default and scheduled bandwidth limits, admin only
+func (c *Client) ResetThrottle(ctx context.Context) (*Throttle, error) {
+	return c.throttle(ctx, http.MethodDelete, nil)
+}
+
+func (c *Client) throttle(ctx context.Context, method string, in interface{}) (*Throttle, error) {
+	var t Throttle
+	if err := c.call(ctx, method, "/api/admin/throttle", in, &t, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+type KeyRequest struct {
+	Name string `json:"name"`
+	apikey.Limits
+	// MEGA handles of files or folders the key may download, empty for any
+	Scopes []string `json:"scopes,omitempty"`
+	// identities of TLS client certificates authenticating as the key
+	Certs []string `json:"certs,omitempty"`
+}
+
+// Key is an API key with its usage
+type Key struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	apikey.Limits
+	Scopes  []string     `json:"scopes,omitempty"`
+	Certs   []string     `json:"certs,omitempty"`
+	Created time.Time    `json:"created"`
+	Usage   apikey.Usage `json:"usage"`
+	// only set by CreateKey
+	Secret string `json:"secret,omitempty"`
+}
+
+// Keys lists the API keys, admin only
+func (c *Client) Keys(ctx context.Context) ([]Key, error) {
+	var list []Key
+	if err := c.call(ctx, http.MethodGet, "/api/admin/keys", nil, &list, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Key returns an API key, admin only
+func (c *Client) Key(ctx context.Context, id string) (*Key, error) {
+	var k Key
+	if err := c.call(ctx, http.MethodGet, "/api/admin/keys/"+url.PathEscape(id), nil, &k, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// CreateKey returns the new key with its secret, which is not shown again, admin only
+func (c *Client) CreateKey(ctx context.Context, req KeyRequest) (*Key, error) {
+	var k Key
+	if err := c.call(ctx, http.MethodPost, "/api/admin/keys", req, &k, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// DeleteKey revokes an API key, admin only
+func (c *Client) DeleteKey(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, "/api/admin/keys/"+url.PathEscape(id), nil, nil, http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/server"
+	"github.com/mocukie/megalink/web/auth"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	content := make([]byte, 10_000)
+	rand.Read(content)
+	mc, link := megatest.NewClient("résumé.pdf", content)
+	signer, err := linksign.NewSigner([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := alias.Open(filepath.Join(dir, "aliases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.Open(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := server.New(server.Options{
+		Client:      mc,
+		BasePath:    "/megalink",
+		Auth:        auth.Config{Tokens: []string{"t0ken"}},
+		LocalAdmins: true,
+		Signer:      signer,
+		Aliases:     aliases,
+		Keys:        keys,
+		Throttle:    throttle.New(throttle.Limits{}, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	ctx := context.Background()
+
+	anon, err := New(srv.URL+"/megalink/", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = anon.Aliases(ctx); StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("anonymous client: got %v", err)
+	}
+	c, _ := New(srv.URL+"/megalink", Options{Token: "t0ken"})
+
+	target, err := Link(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/megalink/dl/" + link + "/a%20b.pdf"; c.URL(target.Named("a b.pdf")) != want {
+		t.Errorf("URL %s, want %s", c.URL(target.Named("a b.pdf")), want)
+	}
+	info, err := c.Stat(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "résumé.pdf" || info.Size != int64(len(content)) || info.ContentType != "application/pdf" || info.ETag == "" {
+		t.Errorf("stat %+v", info)
+	}
+
+	for _, opts := range []*DownloadOptions{nil, {Offset: 100}, {Offset: 100, Length: 50}, {Offset: 100, IfRange: info.ETag}, {Offset: 100, IfRange: `"changed"`}} {
+		dl, err := c.Download(ctx, target, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		got, err := ioutil.ReadAll(dl)
+		dl.Close()
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if dl.Size != int64(len(content)) || dl.Length != int64(len(got)) || !bytes.Equal(got, content[dl.Offset:dl.Offset+dl.Length]) {
+			t.Errorf("%+v: got %d bytes at %d of %d", opts, len(got), dl.Offset, dl.Size)
+		}
+		if opts != nil && opts.IfRange == "" && dl.Offset != opts.Offset || opts != nil && opts.IfRange == `"changed"` && dl.Offset != 0 {
+			t.Errorf("%+v: served from %d", opts, dl.Offset)
+		}
+	}
+	if _, err = c.Download(ctx, target, &DownloadOptions{Offset: 20_000}); StatusCode(err) != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: got %v", err)
+	}
+
+	megaURL := "https://mega.nz/file/" + strings.Replace(link, "!", "#", 1)
+	signed, err := c.Sign(ctx, SignRequest{Link: megaURL, MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed.URL, srv.URL+"/megalink/s/") {
+		t.Errorf("signed URL %s", signed.URL)
+	}
+	for i, code := range []int{200, 410} {
+		dl, err := c.Download(ctx, Signed(signed.Token), nil)
+		if err == nil {
+			dl.Close()
+		}
+		if code == 200 && err != nil || code != 200 && StatusCode(err) != code {
+			t.Errorf("signed download #%d: got %v, want %d", i, err, code)
+		}
+	}
+
+	if _, err = c.SetAlias(ctx, "report", megaURL); err != nil {
+		t.Fatal(err)
+	}
+	if dl, err := c.Download(ctx, Alias("report", ""), nil); err != nil {
+		t.Error(err)
+	} else {
+		dl.Close()
+	}
+	if list, err := c.Aliases(ctx); err != nil || len(list) != 1 || list[0].Link != link {
+		t.Errorf("aliases %+v, %v", list, err)
+	}
+	if err = c.DeleteAlias(ctx, "report"); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.Alias(ctx, "report"); StatusCode(err) != http.StatusNotFound || err.(*Error).Message != alias.ErrNotFound.Error() {
+		t.Errorf("deleted alias: got %v", err)
+	}
+
+	// admin endpoints are open to loopback clients with LocalAdmins
+	th, err := c.SetThrottle(ctx, throttle.Limits{Global: 1 << 20})
+	if err != nil || th.Global != 1<<20 || th.Source != throttle.SourceOverride {
+		t.Errorf("set throttle %+v, %v", th, err)
+	}
+	if th, err = c.ResetThrottle(ctx); err != nil || th.Source != throttle.SourceDefault {
+		t.Errorf("reset throttle %+v, %v", th, err)
+	}
+	k, err := c.CreateKey(ctx, KeyRequest{Name: "backup", Limits: apikey.Limits{Daily: 1 << 30}})
+	if err != nil || k.Secret == "" {
+		t.Fatalf("create key %+v, %v", k, err)
+	}
+	kc, _ := New(srv.URL+"/megalink", Options{Token: k.Secret})
+	if _, err = kc.Stat(ctx, target); err != nil {
+		t.Errorf("stat with API key: %v", err)
+	}
+	if list, err := c.Keys(ctx); err != nil || len(list) != 1 || list[0].ID != k.ID || list[0].Secret != "" {
+		t.Errorf("keys %+v, %v", list, err)
+	}
+	if err = c.DeleteKey(ctx, k.ID); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.Key(ctx, k.ID); StatusCode(err) != http.StatusNotFound {
+		t.Errorf("deleted key: got %v", err)
+	}
+
+	for _, l := range []string{"abcdefgh!short", "https://mega.nz/folder/abcdefgh#abcdefghijklmnopqrstuv"} {
+		if _, err = Link(l); err == nil {
+			t.Errorf("%q accepted", l)
+		}
+	}
+}
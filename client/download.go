@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/mocukie/megalink/pkg/megalink"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target is a file served by megalink, see Link, Alias and Signed
+type Target struct {
+	path string
+}
+
+// Link targets a MEGA link: a mega.nz URL of a file or of a file inside a folder,
+// or a megalink style link, handle!key or handle!key/file/handle
+func Link(link string) (Target, error) {
+	if l, handle, ok := megalink.ParseLink(link); ok {
+		if megalink.FolderLinkRegex.MatchString(l) {
+			if handle == "" {
+				return Target{}, fmt.Errorf("folder link %q must point to a file", link)
+			}
+			return Target{path: "/dl/" + l + "/file/" + handle}, nil
+		}
+		return Target{path: "/dl/" + l}, nil
+	}
+	for _, r := range megalink.FileLinkRegexs {
+		if r.MatchString(link) {
+			return Target{path: "/dl/" + link}, nil
+		}
+	}
+	if p := strings.Split(link, "/"); len(p) == 3 && megalink.FolderLinkRegex.MatchString(p[0]) && p[1] == "file" && len(p[2]) == 8 {
+		return Target{path: "/dl/" + link}, nil
+	}
+	return Target{}, fmt.Errorf("invalid MEGA link %q", link)
+}
+
+// Alias targets an alias, path is empty for a file alias, or the path of a file inside a folder alias
+func Alias(name, path string) Target {
+	t := Target{path: "/a/" + url.PathEscape(name)}
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		if s != "" {
+			t.path += "/" + url.PathEscape(s)
+		}
+	}
+	return t
+}
+
+// Signed targets a signed link by its token, see Client.Sign
+func Signed(token string) Target {
+	return Target{path: "/s/" + url.PathEscape(token)}
+}
+
+// Named returns t with a filename, which the server sends instead of the name of the MEGA file,
+// on a folder alias it is the file path instead
+func (t Target) Named(filename string) Target {
+	t.path += "/" + url.PathEscape(filename)
+	return t
+}
+
+// URL returns the download URL of t, e.g. for downloaders, it carries no credentials
+func (c *Client) URL(t Target) string {
+	return c.url(t.path)
+}
+
+type FileInfo struct {
+	// from Content-Disposition, the name of the MEGA file unless the target is Named
+	Name string
+	// of the whole file
+	Size        int64
+	ContentType string
+	// strong validator, pass it as DownloadOptions.IfRange to resume a download
+	ETag string
+	// zero if the MEGA file has none
+	ModTime time.Time
+}
+
+// Stat returns the file info of t from its metadata, MEGA storage is not contacted
+// and signed link uses are not consumed
+func (c *Client) Stat(ctx context.Context, t Target) (*FileInfo, error) {
+	req, err := c.newRequest(ctx, http.MethodHead, t.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp)
+	}
+	info := fileInfo(resp)
+	info.Size = resp.ContentLength
+	return info, nil
+}
+
+type DownloadOptions struct {
+	// first byte to download
+	Offset int64
+	// bytes to download from Offset, 0 for the rest of the file
+	Length int64
+	// ETag of the file, the whole file is downloaded instead of the range if it changed
+	IfRange string
+}
+
+// Download is the decrypted body of a download, it must be closed
+type Download struct {
+	io.ReadCloser
+	FileInfo
+	// first byte and length of the body, the whole file unless a range was served
+	Offset, Length int64
+}
+
+// Download streams t from the server, which decrypts it while fetching it from MEGA.
+// A range is asked for when opts sets one, check Download.Offset when IfRange is set.
+func (c *Client) Download(ctx context.Context, t Target, opts *DownloadOptions) (*Download, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, t.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && (opts.Offset > 0 || opts.Length > 0) {
+		rg := fmt.Sprintf("bytes=%d-", opts.Offset)
+		if opts.Length > 0 {
+			rg += strconv.FormatInt(opts.Offset+opts.Length-1, 10)
+		}
+		req.Header.Set("Range", rg)
+		if opts.IfRange != "" {
+			req.Header.Set("If-Range", opts.IfRange)
+		}
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dl := &Download{ReadCloser: resp.Body, FileInfo: *fileInfo(resp)}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		dl.Size, dl.Length = resp.ContentLength, resp.ContentLength
+	case http.StatusPartialContent:
+		var e int64
+		if _, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &dl.Offset, &e, &dl.Size); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		dl.Length = e - dl.Offset + 1
+	default:
+		defer resp.Body.Close()
+		return nil, newError(resp)
+	}
+	return dl, nil
+}
+
+func fileInfo(resp *http.Response) *FileInfo {
+	info := &FileInfo{ContentType: resp.Header.Get("Content-Type"), ETag: resp.Header.Get("ETag")}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		info.Name = params["filename"]
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info
+}
@@ -0,0 +1,443 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/server"
+	"github.com/mocukie/megalink/web/auth"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type object = map[string]interface{}
+
+// spec checks the requests and responses going through it against the OpenAPI document
+// the server serves, so that the document and the handlers can't drift apart
+type spec struct {
+	t    *testing.T
+	doc  object
+	base string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (s *spec) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	for _, e := range s.check(req, reqBody, resp, body) {
+		s.t.Errorf("%s %s: %s", req.Method, req.URL.Path, e)
+	}
+	return resp, nil
+}
+
+// operation finds the operation of the request, the template with the most literal
+// segments wins, e.g. /dl/{link}/file/{handle} over /dl/{link}/{filename}
+func (s *spec) operation(method, path string) (template string, op object) {
+	best := -1
+	for tpl, item := range s.doc["paths"].(object) {
+		expr := regexp.QuoteMeta(tpl)
+		expr = strings.ReplaceAll(expr, `\{path\}`, `.+`)
+		expr = regexp.MustCompile(`\\\{[a-z]+\\\}`).ReplaceAllString(expr, `[^/]+`)
+		if !regexp.MustCompile("^" + expr + "$").MatchString(path) {
+			continue
+		}
+		o, ok := item.(object)[strings.ToLower(method)].(object)
+		if literal := strings.Count(tpl, "/") - strings.Count(tpl, "{"); ok && literal > best {
+			best, template, op = literal, tpl, o
+		}
+	}
+	return
+}
+
+func (s *spec) check(req *http.Request, reqBody []byte, resp *http.Response, body []byte) (errs []string) {
+	tpl, op := s.operation(req.Method, strings.TrimPrefix(req.URL.Path, s.base))
+	if op == nil {
+		return []string{"undocumented operation"}
+	}
+	s.mu.Lock()
+	s.seen[req.Method+" "+tpl] = true
+	s.mu.Unlock()
+
+	// the schemas describe valid requests, those the server refused on purpose are not checked
+	if rb, ok := op["requestBody"].(object); ok && len(reqBody) != 0 && resp.StatusCode < 300 {
+		schema := s.resolve(s.resolve(rb)["content"].(object)["application/json"].(object)["schema"].(object))
+		var v interface{}
+		if err := json.Unmarshal(reqBody, &v); err != nil {
+			return []string{"request body: " + err.Error()}
+		}
+		errs = append(errs, s.validate(schema, v, "request body")...)
+	}
+
+	// every authenticated route may answer 401, as the description of the document says
+	if resp.StatusCode == http.StatusUnauthorized {
+		if sec, ok := op["security"].([]interface{}); ok && len(sec) == 1 && len(sec[0].(object)) == 0 {
+			errs = append(errs, "401 from a route without authentication")
+		}
+		return errs
+	}
+	responses := op["responses"].(object)
+	r, ok := responses[strconv.Itoa(resp.StatusCode)].(object)
+	if !ok {
+		if r, ok = responses["default"].(object); !ok {
+			return append(errs, fmt.Sprintf("undocumented status %d", resp.StatusCode))
+		}
+	}
+	r = s.resolve(r)
+	for name := range s.objectOf(r["headers"]) {
+		if name != "Retry-After" && name != "Last-Modified" && resp.Header.Get(name) == "" {
+			errs = append(errs, fmt.Sprintf("%d without %s header", resp.StatusCode, name))
+		}
+	}
+	content := s.objectOf(r["content"])
+	if len(content) == 0 || req.Method == http.MethodHead || len(body) == 0 {
+		return errs
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	media, ok := content[mediaType].(object)
+	if !ok {
+		// files keep their own type, a binary schema stands for any
+		for _, m := range content {
+			if sc := s.resolve(m.(object)["schema"].(object)); sc["format"] == "binary" {
+				return errs
+			}
+		}
+		return append(errs, fmt.Sprintf("%d with undocumented content type %s", resp.StatusCode, mediaType))
+	}
+	if mediaType != "application/json" {
+		return errs
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return append(errs, "response body: "+err.Error())
+	}
+	return append(errs, s.validate(s.resolve(media["schema"].(object)), v, fmt.Sprintf("%d body", resp.StatusCode))...)
+}
+
+func (s *spec) objectOf(v interface{}) object {
+	o, _ := v.(object)
+	return o
+}
+
+// resolve follows a local $ref
+func (s *spec) resolve(o object) object {
+	for {
+		ref, ok := o["$ref"].(string)
+		if !ok {
+			return o
+		}
+		var cur interface{} = s.doc
+		for _, p := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			cur = cur.(object)[p]
+		}
+		o = cur.(object)
+	}
+}
+
+// properties merges the properties and required lists of schema and its allOf parts
+func (s *spec) properties(schema object, props object, required map[string]bool) {
+	for k, v := range s.objectOf(schema["properties"]) {
+		props[k] = v
+	}
+	if req, ok := schema["required"].([]interface{}); ok {
+		for _, k := range req {
+			required[k.(string)] = true
+		}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			s.properties(s.resolve(sub.(object)), props, required)
+		}
+	}
+}
+
+// validate supports the keywords the document uses, properties that are not documented
+// are errors too, so that new fields can't be forgotten
+func (s *spec) validate(schema object, v interface{}, at string) (errs []string) {
+	schema = s.resolve(schema)
+	typ, _ := schema["type"].(string)
+	if _, ok := schema["allOf"]; ok && typ == "" {
+		typ = "object"
+	}
+	switch typ {
+	case "object":
+		o, ok := v.(object)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not an object", at, v)}
+		}
+		props, required := object{}, map[string]bool{}
+		s.properties(schema, props, required)
+		for k := range required {
+			if _, ok := o[k]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: required %s missing", at, k))
+			}
+		}
+		keys := make([]string, 0, len(o))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := props[k].(object)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: undocumented property %s", at, k))
+				continue
+			}
+			errs = append(errs, s.validate(p, o[k], at+"."+k)...)
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not an array", at, v)}
+		}
+		for i, e := range a {
+			errs = append(errs, s.validate(schema["items"].(object), e, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not a string", at, v)}
+		}
+		switch schema["format"] {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is no date-time", at, str))
+			}
+		case "uri":
+			if u, err := url.Parse(str); err != nil || !u.IsAbs() {
+				errs = append(errs, fmt.Sprintf("%s: %q is no absolute URI", at, str))
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || typ == "integer" && n != math.Trunc(n) {
+			return []string{fmt.Sprintf("%s: %v is not an %s", at, v, typ)}
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			errs = append(errs, fmt.Sprintf("%s: %v is below %v", at, n, min))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("%s: %v is not a boolean", at, v)}
+		}
+	default:
+		return []string{fmt.Sprintf("%s: unsupported schema %v", at, schema)}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", at, v, enum))
+		}
+	}
+	return errs
+}
+
+// TestSpec round-trips every client call, successes and errors, through the real handlers and
+// checks the requests and responses against /api/openapi.json
+func TestSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	mc, link, folderLink := megatest.NewFileClient(megatest.File{Name: "report.pdf", Content: make([]byte, 1000), ModTime: time.Now()})
+	signer, err := linksign.NewSigner([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := alias.Open(filepath.Join(dir, "aliases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.Open(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := server.New(server.Options{
+		Client:   mc,
+		BasePath: "/megalink",
+		Auth: auth.Config{Keys: keys, Authenticate: func(req *http.Request) (string, bool) {
+			u, p, ok := req.BasicAuth()
+			return u, ok && p == "secret"
+		}},
+		Admins:   []string{"root"},
+		Signer:   signer,
+		Aliases:  aliases,
+		Keys:     keys,
+		Throttle: throttle.New(throttle.Limits{}, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/megalink/api/openapi.json", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &spec{t: t, base: "/megalink", seen: map[string]bool{}}
+	err = json.NewDecoder(resp.Body).Decode(&s.doc)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Transport: s}
+	newClient := func(opts Options) *Client {
+		opts.HTTPClient = hc
+		c, err := New(srv.URL+"/megalink", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	anon := newClient(Options{})
+	root := newClient(Options{Username: "root", Password: "secret"})
+	alice := newClient(Options{Username: "alice", Password: "secret"})
+	ctx := context.Background()
+	// the statuses are checked by TestClient and the handler tests, errors are only logged here
+	try := func(what string, err error) {
+		if err != nil {
+			t.Logf("%s: %v", what, err)
+		}
+	}
+	download := func(c *Client, target Target, opts *DownloadOptions) {
+		if dl, err := c.Download(ctx, target, opts); err == nil {
+			dl.Close()
+		}
+	}
+
+	try("ready", anon.Ready(ctx))
+	_, err = anon.Aliases(ctx)
+	try("anonymous", err)
+
+	file, _ := Link(link)
+	inFolder, _ := Link(folderLink + "/file/" + megatest.Handle)
+	info, _ := alice.Stat(ctx, file)
+	for _, target := range []Target{file, file.Named("a b.pdf"), inFolder, inFolder.Named("x.pdf"), Target{path: "/dl/abcdefgh!unknown"}} {
+		_, err = alice.Stat(ctx, target)
+		try("stat", err)
+		for _, opts := range []*DownloadOptions{nil, {Offset: 10}, {Offset: 10, Length: 10, IfRange: info.ETag}, {Offset: 5000}} {
+			download(alice, target, opts)
+		}
+	}
+
+	for _, req := range []SignRequest{
+		{Link: link, TTL: 60, MaxUses: 1, Filename: "x.pdf"},
+		{Link: folderLink + "/file/" + megatest.Handle, TTL: -1, BindIP: true},
+		{Link: folderLink},
+		{Link: "nonsense"},
+	} {
+		signed, err := alice.Sign(ctx, req)
+		try("sign", err)
+		if err == nil {
+			_, err = alice.Stat(ctx, Signed(signed.Token))
+			try("stat signed", err)
+			download(alice, Signed(signed.Token), nil)
+			download(alice, Signed(signed.Token).Named("y.pdf"), nil)
+		}
+	}
+	download(alice, Signed("invalid"), nil)
+
+	for _, l := range []string{link, folderLink, folderLink + "/file/" + megatest.Handle, "nonsense"} {
+		_, err = root.SetAlias(ctx, "team", l)
+		try("set alias", err)
+		_, err = alice.Stat(ctx, Alias("team", ""))
+		try("stat alias", err)
+		download(alice, Alias("team", "report.pdf"), nil)
+	}
+	for _, c := range []*Client{alice, root} {
+		_, err = c.Aliases(ctx)
+		try("aliases", err)
+		_, err = c.Alias(ctx, "team")
+		try("alias", err)
+	}
+	_, err = alice.SetAlias(ctx, "team", link)
+	try("set alias", err)
+	try("delete alias", alice.DeleteAlias(ctx, "team"))
+	try("delete alias", root.DeleteAlias(ctx, "team"))
+	try("delete alias", root.DeleteAlias(ctx, "team"))
+	_, err = alice.Alias(ctx, "team")
+	try("deleted alias", err)
+	download(alice, Alias("team", ""), nil)
+
+	for _, c := range []*Client{alice, root} {
+		_, err = c.Throttle(ctx)
+		try("throttle", err)
+		_, err = c.SetThrottle(ctx, throttle.Limits{Global: 1 << 20, PerConn: 1 << 10})
+		try("set throttle", err)
+		_, err = c.SetThrottle(ctx, throttle.Limits{Global: -1})
+		try("set throttle", err)
+		_, err = c.ResetThrottle(ctx)
+		try("reset throttle", err)
+
+		k, err := c.CreateKey(ctx, KeyRequest{Name: "team", Limits: apikey.Limits{Daily: 1 << 30, MaxStreams: 2}, Scopes: []string{megatest.Handle}})
+		try("create key", err)
+		_, err = c.CreateKey(ctx, KeyRequest{})
+		try("create key", err)
+		_, err = c.Keys(ctx)
+		try("keys", err)
+		if k != nil {
+			kc := newClient(Options{Token: k.Secret})
+			download(kc, file, nil)
+			_, err = kc.Sign(ctx, SignRequest{Link: link})
+			try("sign with key", err)
+			_, err = c.Key(ctx, k.ID)
+			try("key", err)
+			try("delete key", c.DeleteKey(ctx, k.ID))
+		}
+		_, err = c.Key(ctx, "unknown")
+		try("key", err)
+		try("delete key", c.DeleteKey(ctx, "unknown"))
+	}
+
+	// every route is documented, see TestOpenAPI, those a client never calls, e.g. HEAD /readyz, are left out
+	for _, op := range []string{
+		"GET /readyz", "POST /api/sign", "GET /api/aliases", "GET /api/aliases/{name}", "PUT /api/aliases/{name}",
+		"DELETE /api/aliases/{name}", "GET /api/admin/throttle", "PUT /api/admin/throttle", "DELETE /api/admin/throttle",
+		"GET /api/admin/keys", "POST /api/admin/keys", "GET /api/admin/keys/{id}", "DELETE /api/admin/keys/{id}",
+		"HEAD /dl/{link}", "GET /dl/{link}", "HEAD /dl/{link}/{filename}", "GET /dl/{link}/{filename}",
+		"HEAD /dl/{link}/file/{handle}", "GET /dl/{link}/file/{handle}", "HEAD /dl/{link}/file/{handle}/{filename}",
+		"GET /dl/{link}/file/{handle}/{filename}", "HEAD /s/{token}", "GET /s/{token}", "GET /s/{token}/{filename}",
+		"HEAD /a/{alias}", "GET /a/{alias}/{path}",
+	} {
+		if !s.seen[op] {
+			t.Errorf("%s not exercised", op)
+		}
+	}
+}
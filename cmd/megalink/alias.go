@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/megalink"
+	"os"
+	"text/tabwriter"
+)
+
+const aliasUsage = `usage: megalink --alias.file FILE alias <command>
+
+commands:
+  ls                 list aliases
+  set NAME LINK      create or update an alias of a MEGA file or folder link
+  rm NAME            delete an alias
+`
+
+func aliasCmd(file string, args []string) error {
+	if file == "" {
+		return fmt.Errorf("--%s is required\n\n%s", OptionAliasFile, aliasUsage)
+	}
+	store, err := alias.Open(file)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "ls":
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tLINK\tUPDATED")
+		for _, e := range list {
+			link := e.Link
+			if e.Handle != "" {
+				link += "/file/" + e.Handle
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.Name, link, e.Updated.Local().Format("2006-01-02 15:04:05"))
+		}
+		return w.Flush()
+	case len(args) == 3 && args[0] == "set":
+		link, handle, ok := megalink.ParseLink(args[2])
+		if !ok {
+			return fmt.Errorf("invalid MEGA link %q", args[2])
+		}
+		_, err = store.Set(alias.Entry{Name: args[1], Link: link, Handle: handle})
+		return err
+	case len(args) == 2 && args[0] == "rm":
+		return store.Delete(args[1])
+	default:
+		return fmt.Errorf("%s", aliasUsage)
+	}
+}
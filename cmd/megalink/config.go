@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/logging"
+	"github.com/mocukie/megalink/web"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const configName = "megalink"
+
+// secrets are masked when the config is printed
+var secretOptions = map[string]bool{
+	OptionAuthTokens:     true,
+	OptionAuthOIDCSecret: true,
+	OptionSessionSecret:  true,
+	OptionSignSecret:     true,
+	OptionMetricsToken:   true,
+}
+
+// command line only, they make no sense in a config file
+var cliOptions = map[string]bool{
+	OptionConfig:   true,
+	"version":      true,
+	"print-config": true,
+}
+
+// bindOptions makes v read flags, which win over MEGALINK_* environment variables,
+// which win over whatever is merged in from a config file
+func bindOptions(v *viper.Viper, flags *pflag.FlagSet) {
+	v.AutomaticEnv()
+	v.SetEnvPrefix("MEGALINK")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	_ = v.BindPFlags(flags)
+}
+
+func configPaths() []string {
+	paths := []string{"."}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, configName))
+	}
+	return append(paths, "/etc/"+configName)
+}
+
+// readConfig reads file, or the first megalink.{yaml,yml,toml,json} found in configPaths when
+// it is empty, and checks every option in it against flags. It returns nil when no file is found.
+func readConfig(file string, flags *pflag.FlagSet) (*viper.Viper, error) {
+	v := viper.New()
+	if file != "" {
+		v.SetConfigFile(file)
+	} else {
+		v.SetConfigName(configName)
+		for _, p := range configPaths() {
+			v.AddConfigPath(p)
+		}
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, errorx.Decorate(err, "read config file failed")
+	}
+
+	var errs []string
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := flags.Lookup(key)
+		if f == nil || cliOptions[key] {
+			errs = append(errs, fmt.Sprintf("unknown option %q", key))
+			continue
+		}
+		if err := checkType(f.Value.Type(), v.Get(key)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("invalid config file %s:\n  %s", v.ConfigFileUsed(), strings.Join(errs, "\n  "))
+	}
+	return v, nil
+}
+
+// checkType checks that a config file value converts to the type of its flag
+func checkType(typ string, val interface{}) (err error) {
+	switch typ {
+	case "bool":
+		_, err = cast.ToBoolE(val)
+	case "int":
+		_, err = cast.ToIntE(val)
+	case "int64":
+		_, err = cast.ToInt64E(val)
+	case "float64":
+		_, err = cast.ToFloat64E(val)
+	case "duration":
+		_, err = cast.ToDurationE(val)
+	case "stringSlice":
+		_, err = cast.ToStringSliceE(val)
+	default:
+		switch val.(type) {
+		case map[string]interface{}, []interface{}:
+			err = errors.New("want a single value")
+		default:
+			_, err = cast.ToStringE(val)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("want %s, got %v", typeName(typ), val)
+	}
+	return nil
+}
+
+func typeName(typ string) string {
+	switch typ {
+	case "int", "int64":
+		return "an integer"
+	case "float64":
+		return "a number"
+	case "duration":
+		return `a duration like "30s" or "1h"`
+	case "stringSlice":
+		return "a list of strings"
+	case "bool":
+		return "true or false"
+	default:
+		return "a " + typ
+	}
+}
+
+// validateConfig checks the merged options, wherever they come from
+func validateConfig(v *viper.Viper) error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if (v.GetString(OptionTLSCert) == "") != (v.GetString(OptionTLSKey) == "") {
+		fail("%s and %s must be set together", OptionTLSCert, OptionTLSKey)
+	}
+	if v.GetBool(OptionTLSSelfSigned) && v.GetString(OptionTLSCert) != "" {
+		fail("%s and %s exclude each other", OptionTLSSelfSigned, OptionTLSCert)
+	}
+	if v.GetString(OptionTLSClientCA) != "" && !tlsEnabled(v) {
+		fail("%s needs %s and %s, or %s", OptionTLSClientCA, OptionTLSCert, OptionTLSKey, OptionTLSSelfSigned)
+	}
+	if specs, err := listenSpecs(v); err != nil {
+		fail("%s: %v", OptionListen, err)
+	} else {
+		for _, spec := range specs {
+			if spec.UseTLS(false) && !tlsEnabled(v) {
+				fail("listener %s has tls=on, which needs %s and %s, or %s", spec, OptionTLSCert, OptionTLSKey, OptionTLSSelfSigned)
+			}
+		}
+	}
+	if addr := v.GetString(OptionHTTP3); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fail("%s: %v", OptionHTTP3, err)
+		}
+		if !tlsEnabled(v) {
+			fail("%s needs %s and %s, or %s", OptionHTTP3, OptionTLSCert, OptionTLSKey, OptionTLSSelfSigned)
+		}
+	}
+	if p := web.CleanBasePath(v.GetString(OptionBasePath)); p != "" && (path.Clean(p) != p || strings.ContainsAny(p, "?#%")) {
+		fail("%s must be a plain path like /megalink", OptionBasePath)
+	}
+	if v.GetInt(OptionDlConns) < 1 {
+		fail("%s must be at least 1", OptionDlConns)
+	}
+	if v.GetInt64(OptionDlSegment) <= 0 {
+		fail("%s must be positive", OptionDlSegment)
+	}
+	if proxy := v.GetString(OptionUpstreamProxy); proxy != "" {
+		if u, err := url.Parse(proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("%s must be a URL like http://host:port", OptionUpstreamProxy)
+		}
+	}
+	for _, key := range []string{OptionLimitRate, OptionLimitBurst, OptionLimitStreams} {
+		if v.GetFloat64(key) < 0 {
+			fail("%s must not be negative", key)
+		}
+	}
+	for _, key := range []string{OptionUpstreamTimeout, OptionShutdownGrace, OptionSignTTL, OptionSessionTTL} {
+		if v.GetDuration(key) < 0 {
+			fail("%s must not be negative", key)
+		}
+	}
+	if r := v.GetFloat64(OptionTraceSample); r < 0 || r > 1 {
+		fail("%s must be between 0 and 1", OptionTraceSample)
+	}
+	if v.GetBool(OptionSignRequired) && v.GetString(OptionSignSecret) == "" {
+		fail("%s requires %s", OptionSignRequired, OptionSignSecret)
+	}
+	if _, _, err := parseThrottle(v); err != nil {
+		fail("invalid bandwidth limits: %v", err)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// optionValue returns the option of flag f, converted to the flag type
+func optionValue(v *viper.Viper, f *pflag.Flag) interface{} {
+	switch f.Value.Type() {
+	case "bool":
+		return v.GetBool(f.Name)
+	case "int":
+		return v.GetInt(f.Name)
+	case "int64":
+		return v.GetInt64(f.Name)
+	case "float64":
+		return v.GetFloat64(f.Name)
+	case "duration":
+		return v.GetDuration(f.Name).String()
+	case "stringSlice":
+		return append([]string{}, v.GetStringSlice(f.Name)...)
+	default:
+		return v.GetString(f.Name)
+	}
+}
+
+// printConfig writes the effective options as yaml, in the config file layout
+func printConfig(w io.Writer, v *viper.Viper, flags *pflag.FlagSet) error {
+	root := make(map[string]interface{})
+	flags.VisitAll(func(f *pflag.Flag) {
+		if cliOptions[f.Name] {
+			return
+		}
+		val := optionValue(v, f)
+		if secretOptions[f.Name] {
+			switch s := val.(type) {
+			case []string:
+				for i := range s {
+					s[i] = logging.Redacted
+				}
+			case string:
+				if s != "" {
+					val = logging.Redacted
+				}
+			}
+		}
+
+		m := root
+		path := strings.Split(f.Name, ".")
+		for _, p := range path[:len(path)-1] {
+			sub, ok := m[p].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				m[p] = sub
+			}
+			m = sub
+		}
+		m[path[len(path)-1]] = val
+	})
+
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
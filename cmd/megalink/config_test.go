@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func testFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String(OptionConfig, "", "")
+	flags.String(OptionServerAddr, "127.0.0.1:30303", "")
+	flags.Float64(OptionLimitRate, 0, "")
+	flags.Int(OptionLimitStreams, 0, "")
+	flags.Duration(OptionShutdownGrace, 30*time.Second, "")
+	flags.StringSlice(OptionAuthTokens, nil, "")
+	flags.String(OptionSignSecret, "", "")
+	return flags
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadConfig(t *testing.T) {
+	flags := testFlags()
+
+	file := writeConfig(t, "megalink.yaml", `
+limit:
+  rate: fast
+  streamz: 2
+shutdown:
+  grace: 1m
+config: other.yaml
+`)
+	_, err := readConfig(file, flags)
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, want := range []string{`limit.rate: want a number, got fast`, `unknown option "limit.streamz"`, `unknown option "config"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q lacks %q", err, want)
+		}
+	}
+
+	file = writeConfig(t, "megalink.toml", `
+addr = "0.0.0.0:8080"
+[limit]
+rate = 2.5
+[auth]
+tokens = ["t0ken1", "t0ken2"]
+`)
+	conf, err := readConfig(file, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := viper.New()
+	_ = v.BindPFlags(flags)
+	_ = flags.Parse([]string{"--" + OptionLimitStreams, "3"})
+	_ = v.MergeConfigMap(conf.AllSettings())
+
+	var out bytes.Buffer
+	if err = printConfig(&out, v, flags); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"addr: 0.0.0.0:8080", "rate: 2.5", "streams: 3", "grace: 30s", "- REDACTED"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("printed config lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "t0ken") || strings.Contains(out.String(), "config:") {
+		t.Errorf("printed config leaks secrets or cli options:\n%s", out.String())
+	}
+
+	if conf, err = readConfig(filepath.Join(t.TempDir(), "missing.yaml"), flags); err == nil {
+		t.Error("missing --config file accepted")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	v := viper.New()
+	v.Set(OptionServerAddr, "127.0.0.1:30303")
+	v.Set(OptionDlConns, 1)
+	v.Set(OptionDlSegment, 1<<20)
+	v.Set(OptionTraceSample, 1)
+	v.Set(OptionThrottleGlobal, "0")
+	v.Set(OptionThrottleConn, "512K")
+	if err := validateConfig(v); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	v.Set(OptionTLSCert, "cert.pem")
+	v.Set(OptionDlConns, 0)
+	v.Set(OptionLimitRate, -1)
+	v.Set(OptionUpstreamProxy, "proxy:3128")
+	v.Set(OptionSignRequired, true)
+	v.Set(OptionThrottleSchedule, []string{"sun 25:00-26:00 1M"})
+	v.Set(OptionListen, []string{"[::]:8080?tls=off", "unix:///run/megalink.sock?tls=on", "udp://:53"})
+	v.Set(OptionBasePath, "/megalink/../x")
+	err := validateConfig(v)
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, want := range []string{OptionTLSKey, OptionDlConns, OptionLimitRate, OptionUpstreamProxy, OptionSignSecret, "bandwidth", "udp://:53", OptionBasePath} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q lacks %q", err, want)
+		}
+	}
+
+	v = viper.New()
+	v.Set(OptionDlConns, 1)
+	v.Set(OptionDlSegment, 1<<20)
+	v.Set(OptionThrottleGlobal, "0")
+	v.Set(OptionThrottleConn, "0")
+	v.Set(OptionListen, []string{"[::]:8080", "unix:///run/megalink.sock?tls=on"})
+	v.Set(OptionHTTP3, ":443")
+	if err = validateConfig(v); err == nil || !strings.Contains(err.Error(), "unix:///run/megalink.sock has tls=on") {
+		t.Errorf("tls listener without certificate: got %v", err)
+	} else if !strings.Contains(err.Error(), OptionHTTP3+" needs") {
+		t.Errorf("http3 without certificate: got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/megalink"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const doctorUsage = `usage: megalink doctor [LINK]
+
+checks the way to MEGA: DNS, TLS, api latency and the transfer quota of this IP address,
+with a MEGA file LINK the storage server serving it too, upstream.* options apply
+`
+
+const (
+	checkOK   = "ok"
+	checkFail = "FAIL"
+	checkSkip = "skip"
+
+	doctorTimeout = 15 * time.Second
+	apiPings      = 3
+)
+
+type checkResult struct {
+	name, result, detail string
+}
+
+type doctor struct {
+	client *mega.Client
+	// DNS and TLS are the proxy's business when set
+	proxy string
+	// MEGA api host, checked by dns and tls
+	apiHost string
+	// resolved file of the storage check, nil skips it
+	file func(ctx context.Context) (*mega.NodeInfo, error)
+}
+
+func doctorCmd(v *viper.Viper, args []string) error {
+	hc, err := newUpstreamClient(v.GetString(OptionUpstreamProxy), v.GetDuration(OptionUpstreamTimeout))
+	if err != nil {
+		return err
+	}
+	d, err := newDoctor(mega.NewClient(hc), v.GetString(OptionUpstreamProxy), args)
+	if err != nil {
+		return err
+	}
+	return d.run(os.Stdout)
+}
+
+func newDoctor(client *mega.Client, proxy string, args []string) (*doctor, error) {
+	u, _ := url.Parse(mega.ApiURL)
+	d := &doctor{client: client, proxy: proxy, apiHost: u.Hostname()}
+	switch len(args) {
+	case 0:
+	case 1:
+		link, handle, ok := megalink.ParseLink(args[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid MEGA link %q\n\n%s", args[0], doctorUsage)
+		}
+		g := strings.Split(link, "!")
+		if handle == "" && megalink.FolderLinkRegex.MatchString(link) {
+			return nil, fmt.Errorf("folder link must point to a file\n\n%s", doctorUsage)
+		}
+		d.file = func(ctx context.Context) (*mega.NodeInfo, error) {
+			if handle == "" {
+				return client.GetPublicFileNodeInfoContext(ctx, g[0], g[0], g[1])
+			}
+			fm, err := client.OpenPublicFolderContext(ctx, g[0], g[1])
+			if err != nil {
+				return nil, err
+			}
+			n := fm.Lookup(handle)
+			if n == nil || n.Type != mega.TypeFile {
+				return nil, mega.API_ENOENT
+			}
+			return fm.GetFileNodeInfoContext(ctx, n)
+		}
+	default:
+		return nil, errors.New(doctorUsage)
+	}
+	return d, nil
+}
+
+// run prints a line per check as soon as it is done and fails when any check failed
+func (d *doctor) run(w io.Writer) error {
+	const row = "%-8s %-6s %s\n"
+	fmt.Fprintf(w, row, "CHECK", "RESULT", "DETAIL")
+	failed := 0
+	for _, check := range []func(ctx context.Context) checkResult{d.dns, d.tls, d.api, d.quota, d.storage} {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		r := check(ctx)
+		cancel()
+		if r.result == checkFail {
+			failed++
+		}
+		fmt.Fprintf(w, row, r.name, r.result, r.detail)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of the checks failed", failed)
+	}
+	return nil
+}
+
+func (d *doctor) dns(ctx context.Context) checkResult {
+	r := checkResult{name: "dns"}
+	if d.proxy != "" {
+		r.result, r.detail = checkSkip, "names are resolved by the proxy "+d.proxy
+		return r
+	}
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, d.apiHost)
+	if err != nil {
+		r.result, r.detail = checkFail, err.Error()
+		return r
+	}
+	r.result, r.detail = checkOK, fmt.Sprintf("%s: %s in %s", d.apiHost, strings.Join(addrs, ", "), ms(time.Since(start)))
+	return r
+}
+
+func (d *doctor) tls(ctx context.Context) checkResult {
+	r := checkResult{name: "tls"}
+	if d.proxy != "" {
+		r.result, r.detail = checkSkip, "connections go through the proxy "+d.proxy
+		return r
+	}
+	start := time.Now()
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: d.apiHost}}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.apiHost, "443"))
+	if err != nil {
+		r.result, r.detail = checkFail, err.Error()
+		return r
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	leaf := state.PeerCertificates[0]
+	r.result, r.detail = checkOK, fmt.Sprintf("%s handshake in %s, certificate of %s by %s expires %s",
+		tlsVersion(state.Version), ms(time.Since(start)), leaf.Subject.CommonName, leaf.Issuer.CommonName,
+		leaf.NotAfter.Format("2006-01-02"))
+	return r
+}
+
+func (d *doctor) api(ctx context.Context) checkResult {
+	r := checkResult{name: "api"}
+	var min, max, total time.Duration
+	for i := 0; i < apiPings; i++ {
+		start := time.Now()
+		if err := d.client.PingContext(ctx); err != nil {
+			r.result, r.detail = checkFail, fmt.Sprintf("%s unreachable: %v", mega.ApiURL, err)
+			return r
+		}
+		rtt := time.Since(start)
+		if i == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		total += rtt
+	}
+	r.result, r.detail = checkOK, fmt.Sprintf("latency min %s, avg %s, max %s of %d requests",
+		ms(min), ms(total/apiPings), ms(max), apiPings)
+	return r
+}
+
+func (d *doctor) quota(ctx context.Context) checkResult {
+	r := checkResult{name: "quota"}
+	ok, err := d.client.QueryTransferQuotaContext(ctx, 0)
+	switch {
+	case err != nil:
+		r.result, r.detail = checkFail, err.Error()
+	case !ok:
+		r.result, r.detail = checkFail, "transfer quota of this IP address is used up, downloads fail until MEGA frees it"
+	default:
+		r.result, r.detail = checkOK, "transfer quota available"
+	}
+	return r
+}
+
+func (d *doctor) storage(ctx context.Context) checkResult {
+	r := checkResult{name: "storage"}
+	if d.file == nil {
+		r.result, r.detail = checkSkip, "give a file link to check the storage servers"
+		return r
+	}
+	info, err := d.file(ctx)
+	if err != nil {
+		r.result, r.detail = checkFail, "resolve link: "+err.Error()
+		return r
+	}
+	host := info.URL
+	if u, err := url.Parse(info.URL); err == nil {
+		host = u.Hostname()
+	}
+	start := time.Now()
+	dl, err := d.client.DownloadContext(ctx, info, mega.NewDownloadOption().Range(0, 0))
+	if err != nil {
+		r.result, r.detail = checkFail, fmt.Sprintf("%s: %v", host, err)
+		return r
+	}
+	defer dl.Close()
+	if _, err = io.Copy(io.Discard, dl); err != nil {
+		r.result, r.detail = checkFail, fmt.Sprintf("%s: %v", host, err)
+		return r
+	}
+	r.result, r.detail = checkOK, fmt.Sprintf("%s: first byte in %s", host, ms(time.Since(start)))
+	return r
+}
+
+func ms(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	}
+	return fmt.Sprintf("TLS %#x", v)
+}
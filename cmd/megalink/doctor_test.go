@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	// the api answers, but the transfer quota is used up
+	client := mega.NewClient(&http.Client{Transport: megatest.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("[-17]")), Request: req}, nil
+	})})
+	d, err := newDoctor(client, "http://proxy:3128", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = d.run(&out); err == nil || !strings.Contains(err.Error(), "1 of the checks") {
+		t.Errorf("got %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{"CHECK", "dns      skip", "tls      skip", "api      ok", "quota    FAIL", "storage  skip"}
+	if len(lines) != len(want) {
+		t.Fatalf("got\n%s", out.String())
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(lines[i], w) {
+			t.Errorf("line %d: got %q, want %q...", i, lines[i], w)
+		}
+	}
+
+	for _, args := range [][]string{{"not-a-link"}, {"https://mega.nz/folder/abcdefgh#abcdefghijklmnopqrstuv"}, {"a", "b"}} {
+		if _, err = newDoctor(client, "", args); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const keyUsage = `usage: megalink --keys.file FILE key <command>
+
+commands:
+  ls                      list API keys and their usage
+  add NAME [OPTION=VALUE...]
+                          create an API key and print its secret, options:
+                            daily=SIZE, monthly=SIZE  transfer quotas, K, M and G suffixes accepted
+                            streams=N                 concurrent downloads
+                            scope=HANDLE              allowed MEGA file or folder handle, repeatable
+                            cert=IDENTITY             TLS client certificate (common name, e-mail or
+                                                      DNS name) authenticating as the key, repeatable
+  rm ID                   delete an API key
+`
+
+func keyCmd(file string, args []string) error {
+	if file == "" {
+		return fmt.Errorf("--%s is required\n\n%s", OptionKeysFile, keyUsage)
+	}
+	store, err := apikey.Open(file)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "ls":
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+		report := store.Report()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tTODAY\tDAILY\tMONTH\tMONTHLY\tSTREAMS\tSCOPES\tCERTS")
+		for _, k := range list {
+			u := report[k.ID]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s\t%s\n", k.ID, k.Name,
+				u.DayBytes, limit(k.Daily), u.MonthBytes, limit(k.Monthly), limit(int64(k.MaxStreams)),
+				strings.Join(k.Scopes, ","), strings.Join(k.Certs, ","))
+		}
+		return w.Flush()
+	case len(args) >= 2 && args[0] == "add":
+		var l apikey.Limits
+		var scopes, certs []string
+		for _, opt := range args[2:] {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid option %q\n\n%s", opt, keyUsage)
+			}
+			switch kv[0] {
+			case "daily":
+				l.Daily, err = throttle.ParseRate(kv[1])
+			case "monthly":
+				l.Monthly, err = throttle.ParseRate(kv[1])
+			case "streams":
+				l.MaxStreams, err = strconv.Atoi(kv[1])
+			case "scope":
+				scopes = append(scopes, kv[1])
+			case "cert":
+				certs = append(certs, kv[1])
+			default:
+				err = fmt.Errorf("unknown option %q\n\n%s", kv[0], keyUsage)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		k, secret, err := store.Create(args[1], l, scopes, certs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id:     %s\nsecret: %s\n", k.ID, secret)
+		return nil
+	case len(args) == 2 && args[0] == "rm":
+		return store.Delete(args[1])
+	default:
+		return fmt.Errorf("%s", keyUsage)
+	}
+}
+
+func limit(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -1,73 +1,303 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/mocukie/megalink"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/listen"
+	"github.com/mocukie/megalink/pkg/logging"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/netutil"
+	"github.com/mocukie/megalink/pkg/policy"
+	"github.com/mocukie/megalink/pkg/systemd"
+	"github.com/mocukie/megalink/pkg/telemetry"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/pkg/tlsutil"
+	"github.com/mocukie/megalink/server"
 	"github.com/mocukie/megalink/web"
-	"github.com/mocukie/megalink/web/dl"
-	"github.com/mocukie/megalink/web/static"
+	"github.com/mocukie/megalink/web/auth"
+	"github.com/mocukie/megalink/web/drain"
+	"github.com/mocukie/megalink/web/metrics"
+	"github.com/mocukie/megalink/web/ratelimit"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var version = "0.1.0"
 
-func windowsBrokenPipeRecovery() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		defer func() {
-			if err := recover(); err != nil {
-				var brokenPipe bool
-				if ne, ok := err.(*net.OpError); ok {
-					if se, ok := ne.Err.(*os.SyscallError); ok {
-						if strings.Contains(strings.ToLower(se.Error()), "an established connection was aborted by the software in your host machine") ||
-							strings.Contains(strings.ToLower(se.Error()), "an existing connection was forcibly closed by the remote host") {
-							brokenPipe = true
-						}
-					}
-				}
-				if brokenPipe {
-					c.Error(err.(error))
-					c.Abort()
-				} else {
-					panic(err) //rethrow
-				}
-			}
-		}()
-		c.Next()
+// newUpstreamClient returns the http client of MEGA api and storage requests
+func newUpstreamClient(proxy string, timeout time.Duration) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(u)
 	}
+	// downloads stream for hours, so only the wait for response headers is bounded
+	tr.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: tr}, nil
 }
 
-func setupRouter(e *gin.Engine) {
-	f, _ := fs.Sub(megalink.WWW, "www")
-	routers := []web.IRouter{
-		dl.NewRouter(),
-		static.NewRouter("/", http.FS(f)),
+// parseThrottle returns the default bandwidth limits and the schedule
+func parseThrottle(v *viper.Viper) (base throttle.Limits, windows []throttle.Window, err error) {
+	if base.Global, err = throttle.ParseRate(v.GetString(OptionThrottleGlobal)); err != nil {
+		return
 	}
+	if base.PerConn, err = throttle.ParseRate(v.GetString(OptionThrottleConn)); err != nil {
+		return
+	}
+	for _, s := range v.GetStringSlice(OptionThrottleSchedule) {
+		w, err := throttle.ParseWindow(s)
+		if err != nil {
+			return base, nil, err
+		}
+		windows = append(windows, w)
+	}
+	return
+}
 
-	for _, r := range routers {
-		r.Setup(e)
+// tlsEnabled tells whether a server certificate is configured
+func tlsEnabled(v *viper.Viper) bool {
+	return v.GetString(OptionTLSCert) != "" || v.GetBool(OptionTLSSelfSigned)
+}
+
+// tlsFiles returns the certificate and key files to serve, the self-signed certificate is issued
+// again if its hosts changed or it is about to expire
+func tlsFiles(v *viper.Viper) (certFile, keyFile string, err error) {
+	if !v.GetBool(OptionTLSSelfSigned) {
+		return v.GetString(OptionTLSCert), v.GetString(OptionTLSKey), nil
+	}
+	hosts := v.GetStringSlice(OptionTLSHosts)
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if name, err := os.Hostname(); err == nil && name != "localhost" {
+			hosts = append(hosts, name)
+		}
+	}
+	dir := v.GetString(OptionTLSDir)
+	if dir == "" {
+		conf, err := os.UserConfigDir()
+		if err != nil {
+			return "", "", errorx.Decorate(err, "no --%s given", OptionTLSDir)
+		}
+		dir = filepath.Join(conf, configName, "tls")
 	}
+	return tlsutil.SelfSigned(dir, hosts)
 }
 
-func main() {
-	const (
-		OptionServerAddr = "addr"
-		OptionTLSCert    = "tls.cert"
-		OptionTLSKey     = "tls.key"
-	)
+// listenSpecs returns the listeners of --listen, or --addr without any
+func listenSpecs(v *viper.Viper) ([]listen.Spec, error) {
+	list := v.GetStringSlice(OptionListen)
+	if len(list) == 0 {
+		list = []string{v.GetString(OptionServerAddr)}
+	}
+	specs := make([]listen.Spec, 0, len(list))
+	for _, s := range list {
+		spec, err := listen.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func limitConfig(v *viper.Viper) ratelimit.Config {
+	return ratelimit.Config{
+		Rate:       v.GetFloat64(OptionLimitRate),
+		Burst:      v.GetInt(OptionLimitBurst),
+		MaxStreams: v.GetInt(OptionLimitStreams),
+	}
+}
+
+func logConfig(v *viper.Viper) logging.Config {
+	return logging.Config{
+		Level:  v.GetString(OptionLogLevel),
+		Format: v.GetString(OptionLogFormat),
+		Output: v.GetString(OptionLogOutput),
+	}
+}
+
+// shutdown stops accepting connections and gives the downloads in flight up to grace to finish,
+// a second signal cuts the wait short. It returns how many downloads were interrupted.
+// h3 is nil without HTTP/3, it keeps serving during the grace period as it cannot stop gracefully.
+func shutdown(srv *http.Server, h3 *http3.Server, transfers *drain.Tracker, grace time.Duration, sig <-chan os.Signal) int {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go func() {
+		select {
+		case s := <-sig:
+			logrus.WithField("signal", s.String()).Warn("second signal, skipping the grace period")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"transfers": transfers.Active(),
+		"grace":     grace.String(),
+	}).Info("stopped accepting connections, waiting for transfers to finish")
+	if h3 != nil {
+		defer h3.Close()
+	}
+	if err := srv.Shutdown(ctx); err == nil {
+		// h2c connections are hijacked and HTTP/3 ones are not srv's, their downloads are waited for here
+		if err = transfers.Wait(ctx); err == nil {
+			return 0
+		}
+	}
+
+	n := transfers.Cancel()
+	logrus.WithField("transfers", n).Warn("grace period over, interrupting transfers")
+	// cancelled downloads end once their upstream reads fail, Close unblocks writes to stalled clients
+	wait, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	_ = transfers.Wait(wait)
+	_ = srv.Close()
+	return n
+}
 
-	pflag.StringP(OptionServerAddr, "a", "127.0.0.1:30303", "server listen address")
+const (
+	OptionConfig     = "config"
+	OptionDebug      = "debug"
+	OptionServerAddr = "addr"
+	OptionListen     = "listen"
+	OptionBasePath   = "base_path"
+	OptionH2C        = "h2c"
+	OptionHTTP3      = "http3"
+	OptionTLSCert    = "tls.cert"
+	OptionTLSKey     = "tls.key"
+
+	OptionTLSSelfSigned = "tls.self_signed"
+	OptionTLSHosts      = "tls.hosts"
+	OptionTLSDir        = "tls.dir"
+	OptionTLSClientCA   = "tls.client_ca"
+	OptionDlConns       = "download.conns"
+	OptionDlSegment     = "download.segment"
+
+	OptionUpstreamProxy   = "upstream.proxy"
+	OptionUpstreamTimeout = "upstream.timeout"
+
+	OptionAuthHtpasswd     = "auth.htpasswd"
+	OptionAuthTokens       = "auth.tokens"
+	OptionAuthOIDCIssuer   = "auth.oidc.issuer"
+	OptionAuthOIDCClient   = "auth.oidc.client"
+	OptionAuthOIDCSecret   = "auth.oidc.secret"
+	OptionAuthOIDCRedirect = "auth.oidc.redirect"
+	OptionAuthOIDCUsers    = "auth.oidc.users"
+	OptionSessionSecret    = "auth.session.secret"
+	OptionSessionTTL       = "auth.session.ttl"
+
+	OptionSignSecret   = "sign.secret"
+	OptionSignTTL      = "sign.ttl"
+	OptionSignRequired = "sign.required"
+
+	OptionPolicyFile = "policy.file"
+	OptionAliasFile  = "alias.file"
+	OptionKeysFile   = "keys.file"
+
+	OptionLimitRate    = "limit.rate"
+	OptionLimitBurst   = "limit.burst"
+	OptionLimitStreams = "limit.streams"
+	OptionProxyTrusted = "proxy.trusted"
+
+	OptionThrottleGlobal   = "throttle.global"
+	OptionThrottleConn     = "throttle.conn"
+	OptionThrottleSchedule = "throttle.schedule"
+	OptionAdminUsers       = "admin.users"
+	OptionAdminLocal       = "admin.local"
+
+	OptionMetricsEnabled = "metrics.enabled"
+	OptionMetricsAddr    = "metrics.addr"
+	OptionMetricsToken   = "metrics.token"
+
+	OptionLogLevel  = "log.level"
+	OptionLogFormat = "log.format"
+	OptionLogOutput = "log.output"
+
+	OptionTraceExporter = "trace.exporter"
+	OptionTraceEndpoint = "trace.endpoint"
+	OptionTraceInsecure = "trace.insecure"
+	OptionTraceSample   = "trace.sample"
+
+	OptionShutdownGrace = "shutdown.grace"
+)
+
+func main() {
+	pflag.StringP(OptionConfig, "c", "", "config file (yaml, toml or json), default megalink.yaml etc. in ., the user config dir or /etc/megalink")
+	pflag.Bool(OptionDebug, false, "gin debug mode")
+	pflag.StringP(OptionServerAddr, "a", "127.0.0.1:30303", "server listen address, used when --listen is empty")
+	pflag.StringSlice(OptionListen, nil, "listeners: host:port, unix:///path?mode=0660&owner=u&group=g or systemd://[name], each may add ?tls=on|off")
+	pflag.String(OptionBasePath, "", "path prefix of all routes when published below the root by a reverse proxy, e.g. /megalink")
+	pflag.Bool(OptionH2C, true, "serve HTTP/2 without TLS (h2c) on plain listeners, for proxies and clients with prior knowledge")
+	pflag.String(OptionHTTP3, "", "UDP address to serve HTTP/3 on, e.g. :443, needs TLS and is advertised by Alt-Svc on HTTPS responses")
 	pflag.String(OptionTLSCert, "", "TLS certificate file path")
 	pflag.String(OptionTLSKey, "", "TLS key file path")
+	pflag.Bool(OptionTLSSelfSigned, false, "serve a certificate signed by a CA generated in --tls.dir, instead of --tls.cert and --tls.key")
+	pflag.StringSlice(OptionTLSHosts, nil, "host names and IPs of the self-signed certificate, default localhost, loopback IPs and the host name")
+	pflag.String(OptionTLSDir, "", "directory of the self-signed CA and certificate, default tls in the user config dir of megalink")
+	pflag.String(OptionTLSClientCA, "", "CA certificates file, TLS clients must present a certificate signed by one of them")
+	pflag.Int(OptionDlConns, 1, "concurrent upstream connections per download, 1 disables segmented fetching")
+	pflag.Int64(OptionDlSegment, mega.DefaultSegmentSize, "segment size in bytes of segmented fetching")
+	pflag.String(OptionUpstreamProxy, "", "proxy URL for MEGA api and storage requests, default HTTPS_PROXY")
+	pflag.Duration(OptionUpstreamTimeout, 0, "time to wait for MEGA api and storage response headers, 0 for no limit")
+	pflag.String(OptionAuthHtpasswd, "", "htpasswd file for HTTP basic auth")
+	pflag.StringSlice(OptionAuthTokens, nil, "static bearer tokens, also accepted as ?token= query")
+	pflag.String(OptionAuthOIDCIssuer, "", "OIDC issuer URL for web UI login")
+	pflag.String(OptionAuthOIDCClient, "", "OIDC client id")
+	pflag.String(OptionAuthOIDCSecret, "", "OIDC client secret")
+	pflag.String(OptionAuthOIDCRedirect, "", "OIDC redirect URL, default derived from request host")
+	pflag.StringSlice(OptionAuthOIDCUsers, nil, "OIDC users (verified email or subject) allowed to login, default anyone")
+	pflag.String(OptionSessionSecret, "", "session cookie signing secret, default random per start")
+	pflag.Duration(OptionSessionTTL, 24*time.Hour, "session cookie lifetime")
+	pflag.String(OptionSignSecret, "", "secret of signed download links, enables /s/ links and /api/sign")
+	pflag.Duration(OptionSignTTL, 24*time.Hour, "default expiry of signed links, 0 for never")
+	pflag.Bool(OptionSignRequired, false, "serve signed links only, disables /dl/ links carrying keys")
+	pflag.String(OptionPolicyFile, "", "access policy file (yaml, toml or json), reloaded on change")
+	pflag.String(OptionAliasFile, "", "alias store file, enables /a/ links and /api/aliases")
+	pflag.String(OptionKeysFile, "", "API key store file, enables API keys with quotas and /api/admin/keys")
+	pflag.Float64(OptionLimitRate, 0, "link lookups per second of each client, 0 for unlimited")
+	pflag.Int(OptionLimitBurst, 0, "lookup burst of each client, default the rate rounded up")
+	pflag.Int(OptionLimitStreams, 0, "simultaneous downloads of each client, 0 for unlimited")
+	pflag.StringSlice(OptionProxyTrusted, nil, "trusted reverse proxy IPs or CIDR ranges, or unix for Unix socket peers, their X-Forwarded-For and X-Real-IP are honored")
+	pflag.String(OptionThrottleGlobal, "0", "bandwidth of all downloads in bytes per second, K, M and G suffixes accepted, 0 for unlimited")
+	pflag.String(OptionThrottleConn, "0", "bandwidth of every single download, same format as --throttle.global")
+	pflag.StringSlice(OptionThrottleSchedule, nil, `time-of-day limits replacing the defaults, e.g. "mon-fri 09:00-18:00 2M/512K" (global/per download), first match wins`)
+	pflag.StringSlice(OptionAdminUsers, nil, "users allowed on /api/admin and to see alias keys")
+	pflag.Bool(OptionAdminLocal, false, "loopback clients are admins too, only safe when reverse proxies are listed in proxy.trusted")
+	pflag.Bool(OptionMetricsEnabled, false, "expose prometheus metrics at /metrics")
+	pflag.String(OptionMetricsAddr, "", "serve /metrics on a separate listen address, default the server address")
+	pflag.String(OptionMetricsToken, "", "bearer token required to scrape /metrics")
+	pflag.String(OptionLogLevel, "info", "log level: error, warn, info or debug, debug adds error stack traces")
+	pflag.String(OptionLogFormat, "logfmt", "log format: logfmt or json")
+	pflag.String(OptionLogOutput, "stderr", "log output: stderr, stdout or a file path")
+	pflag.String(OptionTraceExporter, "", "OpenTelemetry trace exporter: otlp or stdout, empty disables tracing")
+	pflag.String(OptionTraceEndpoint, "", "OTLP/HTTP collector host:port, default OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318")
+	pflag.Bool(OptionTraceInsecure, false, "send traces to the collector over plain HTTP")
+	pflag.Float64(OptionTraceSample, 1, "fraction of new traces that are sampled")
+	pflag.Duration(OptionShutdownGrace, 30*time.Second, "time given to downloads in flight to finish on SIGINT or SIGTERM before they are interrupted")
 	printVer := pflag.BoolP("version", "v", false, "print version")
+	printConf := pflag.Bool("print-config", false, "print the effective config, merged from defaults, config file, environment and flags, and exit")
 	pflag.Parse()
 
 	if *printVer {
@@ -75,35 +305,333 @@ func main() {
 		os.Exit(0)
 	}
 
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("MEGALINK")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	_ = viper.BindPFlags(pflag.CommandLine)
+	bindOptions(viper.GetViper(), pflag.CommandLine)
+
+	conf, err := readConfig(viper.GetString(OptionConfig), pflag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if conf != nil {
+		// flags and environment still take precedence
+		_ = viper.MergeConfigMap(conf.AllSettings())
+	}
+	if *printConf {
+		if err := printConfig(os.Stdout, viper.GetViper(), pflag.CommandLine); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if pflag.Arg(0) == "alias" {
+		if err := aliasCmd(viper.GetString(OptionAliasFile), pflag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if pflag.Arg(0) == "doctor" {
+		if err := doctorCmd(viper.GetViper(), pflag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if pflag.Arg(0) == "key" {
+		if err := keyCmd(viper.GetString(OptionKeysFile), pflag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err := validateConfig(viper.GetViper()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := logging.Setup(logConfig(viper.GetViper())); err != nil {
+		fmt.Fprintln(os.Stderr, "setup logging failed:", err)
+		os.Exit(1)
+	}
+	if conf != nil {
+		logrus.WithField("file", conf.ConfigFileUsed()).Info("config file loaded")
+	}
+
+	traceConf := telemetry.Config{
+		Exporter:    viper.GetString(OptionTraceExporter),
+		Endpoint:    viper.GetString(OptionTraceEndpoint),
+		Insecure:    viper.GetBool(OptionTraceInsecure),
+		SampleRatio: viper.GetFloat64(OptionTraceSample),
+		Version:     version,
+	}
+	shutdownTracing, err := telemetry.Setup(context.Background(), traceConf)
+	if err != nil {
+		logrus.Fatalf("setup tracing failed, casuse: %+v", err)
+	}
 
-	addr := viper.GetString(OptionServerAddr)
-	if viper.GetBool("debug") {
+	if viper.GetBool(OptionDebug) {
 		gin.SetMode(gin.DebugMode)
 	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	engine := gin.Default()
-	engine.Use(windowsBrokenPipeRecovery(), func(c *gin.Context) {
-		c.Header("Server", "nginx/1.14.514")
-		c.Next()
-	})
-	setupRouter(engine)
+	hc, err := newUpstreamClient(viper.GetString(OptionUpstreamProxy), viper.GetDuration(OptionUpstreamTimeout))
+	if err != nil {
+		logrus.Fatalf("invalid upstream client options, casuse: %+v", err)
+	}
+	web.MegaClient.SetHTTPClient(hc)
 
-	var err error
-	if cert, key := viper.GetString(OptionTLSCert), viper.GetString(OptionTLSKey); cert != "" && key != "" {
-		fmt.Printf("Listening and serving HTTPS on %s\n", addr)
-		err = http.ListenAndServeTLS(addr, cert, key, engine)
-	} else {
-		fmt.Printf("Listening and serving HTTP on %s\n", addr)
-		err = http.ListenAndServe(addr, engine)
+	var nets []string
+	var trustUnix bool
+	for _, s := range viper.GetStringSlice(OptionProxyTrusted) {
+		if s == listen.NetworkUnix {
+			trustUnix = true
+		} else {
+			nets = append(nets, s)
+		}
+	}
+	trusted, err := netutil.ParseNets(nets)
+	if err != nil {
+		logrus.Fatalf("invalid %s, casuse: %+v", OptionProxyTrusted, err)
+	}
+
+	var m *metrics.Metrics
+	var metricsHandler http.Handler
+	if viper.GetBool(OptionMetricsEnabled) {
+		m = metrics.New()
+		h := m.Handler(viper.GetString(OptionMetricsToken))
+		if maddr := viper.GetString(OptionMetricsAddr); maddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", h)
+			go func() {
+				logrus.Infof("Serving metrics on %s", maddr)
+				if err := http.ListenAndServe(maddr, mux); err != nil {
+					logrus.Fatalf("start metrics server failed, casuse: %+v", err)
+				}
+			}()
+		} else {
+			metricsHandler = h
+		}
+	}
+
+	var signer *linksign.Signer
+	if secret := viper.GetString(OptionSignSecret); secret != "" {
+		var err error
+		if signer, err = linksign.NewSigner([]byte(secret)); err != nil {
+			logrus.Fatalf("create link signer failed, casuse: %+v", err)
+		}
+	}
+
+	var aliases *alias.Store
+	if file := viper.GetString(OptionAliasFile); file != "" {
+		var err error
+		if aliases, err = alias.Open(file); err != nil {
+			logrus.Fatalf("open alias store failed, casuse: %+v", err)
+		}
+	}
+
+	var keys *apikey.Store
+	if file := viper.GetString(OptionKeysFile); file != "" {
+		var err error
+		if keys, err = apikey.Open(file); err != nil {
+			logrus.Fatalf("open key store failed, casuse: %+v", err)
+		}
+	}
+
+	var rules *policy.Engine
+	if file := viper.GetString(OptionPolicyFile); file != "" {
+		var err error
+		if rules, err = policy.Load(file); err != nil {
+			logrus.Fatalf("load policy failed, casuse: %+v", err)
+		}
+	}
+
+	transfers := drain.New()
+	// always set, so that limits can be turned on by a reload
+	limiter := ratelimit.New(limitConfig(viper.GetViper()))
+	// a throttle always exists, so that limits can be set at runtime
+	base, windows, err := parseThrottle(viper.GetViper())
+	if err != nil {
+		logrus.Fatalf("invalid bandwidth limits, casuse: %+v", err)
 	}
+	bw := throttle.New(base, windows)
 
+	if issuer := viper.GetString(OptionAuthOIDCIssuer); issuer != "" && len(viper.GetStringSlice(OptionAuthOIDCUsers)) == 0 {
+		logrus.Warnf("%s is empty, anyone with an account at %s may log in", OptionAuthOIDCUsers, issuer)
+	}
+	handler, err := server.New(server.Options{
+		Client:         web.MegaClient,
+		BasePath:       viper.GetString(OptionBasePath),
+		TrustedProxies: trusted,
+		TrustUnixPeers: trustUnix,
+		Auth: auth.Config{
+			Htpasswd:    viper.GetString(OptionAuthHtpasswd),
+			Tokens:      viper.GetStringSlice(OptionAuthTokens),
+			ClientCerts: viper.GetString(OptionTLSClientCA) != "",
+			OIDC: auth.OIDCConfig{
+				Issuer:       viper.GetString(OptionAuthOIDCIssuer),
+				ClientID:     viper.GetString(OptionAuthOIDCClient),
+				ClientSecret: viper.GetString(OptionAuthOIDCSecret),
+				RedirectURL:  viper.GetString(OptionAuthOIDCRedirect),
+				Users:        viper.GetStringSlice(OptionAuthOIDCUsers),
+			},
+			SessionSecret: viper.GetString(OptionSessionSecret),
+			SessionTTL:    viper.GetDuration(OptionSessionTTL),
+		},
+		Admins:      viper.GetStringSlice(OptionAdminUsers),
+		LocalAdmins: viper.GetBool(OptionAdminLocal),
+		Segment: mega.Segmented{
+			Conns: viper.GetInt(OptionDlConns),
+			Size:  viper.GetInt64(OptionDlSegment),
+		},
+		Signer:         signer,
+		SignTTL:        viper.GetDuration(OptionSignTTL),
+		SignedOnly:     viper.GetBool(OptionSignRequired),
+		Aliases:        aliases,
+		Keys:           keys,
+		Policy:         rules,
+		Limiter:        limiter,
+		Throttle:       bw,
+		Transfers:      transfers,
+		Metrics:        m,
+		MetricsHandler: metricsHandler,
+		Tracing:        traceConf.Exporter != "",
+	})
 	if err != nil {
-		log.Fatalf("start server failed, casuse: %+v", err)
+		logrus.Fatalf("setup router failed, casuse: %+v", err)
+	}
+
+	reload := newReloader(viper.GetString(OptionConfig), viper.GetViper(), pflag.CommandLine)
+	reload.limiter, reload.bw, reload.rules = limiter, bw, rules
+
+	if viper.GetBool(OptionH2C) {
+		handler = withH2C(handler)
+	}
+	// handshake failures and the like, in the log format of the rest
+	srv := &http.Server{Handler: handler, ErrorLog: log.New(logrus.StandardLogger().WriterLevel(logrus.WarnLevel), "", 0)}
+	if tlsEnabled(viper.GetViper()) {
+		certFile, keyFile, err := tlsFiles(viper.GetViper())
+		if err != nil {
+			logrus.Fatalf("set up TLS certificate failed, casuse: %+v", err)
+		}
+		kp, err := tlsutil.LoadKeyPair(certFile, keyFile)
+		if err != nil {
+			logrus.Fatalf("load TLS certificate failed, casuse: %+v", err)
+		}
+		if viper.GetBool(OptionTLSSelfSigned) {
+			logrus.WithField("dir", filepath.Dir(certFile)).Info("serving self-signed certificate, clients may trust ca.pem of dir")
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: kp.GetCertificate}
+		reload.cert = kp
+
+		if file := viper.GetString(OptionTLSClientCA); file != "" {
+			pool, err := tlsutil.LoadCertPool(file)
+			if err != nil {
+				logrus.Fatalf("load client CA failed, casuse: %+v", err)
+			}
+			srv.TLSConfig.ClientCAs = pool
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if conf != nil {
+		reload.watch(conf)
+	}
+
+	// every listener is bound before serving, so that systemd is told ready once all accept connections
+	type boundListener struct {
+		net.Listener
+		tls bool
+	}
+	var bound []boundListener
+	specs, _ := listenSpecs(viper.GetViper())
+	for _, spec := range specs {
+		ls, err := listen.Open(spec)
+		if err != nil {
+			logrus.Fatalf("start server failed, casuse: %+v", err)
+		}
+		for _, l := range ls {
+			bound = append(bound, boundListener{Listener: l, tls: spec.UseTLS(srv.TLSConfig != nil)})
+		}
+	}
+
+	var (
+		h3   *http3.Server
+		udp  net.PacketConn
+		addr = viper.GetString(OptionHTTP3)
+	)
+	if addr != "" {
+		if udp, err = net.ListenPacket("udp", addr); err != nil {
+			logrus.Fatalf("start HTTP/3 server failed, casuse: %+v", err)
+		}
+		defer udp.Close()
+		// a copy, ServeTLS adds its protocols to srv.TLSConfig
+		h3 = newHTTP3Server(handler, srv.TLSConfig.Clone())
+		srv.Handler = withAltSvc(srv.Handler, h3)
+	}
+
+	errc := make(chan error, len(bound)+1)
+	basePath := web.CleanBasePath(viper.GetString(OptionBasePath))
+	addrs := make([]string, len(bound))
+	for i, l := range bound {
+		addrs[i] = l.Addr().Network() + "://" + l.Addr().String()
+		go func(l boundListener, addr string) {
+			if l.tls {
+				logrus.Infof("Listening and serving HTTPS on %s%s", addr, basePath)
+				errc <- srv.ServeTLS(l.Listener, "", "")
+			} else {
+				logrus.Infof("Listening and serving HTTP on %s%s", addr, basePath)
+				errc <- srv.Serve(l.Listener)
+			}
+		}(l, addrs[i])
+	}
+	if h3 != nil {
+		addr := "udp://" + udp.LocalAddr().String()
+		addrs = append(addrs, addr)
+		logrus.Infof("Listening and serving HTTP/3 on %s%s", addr, basePath)
+		go func() {
+			errc <- h3.Serve(udp)
+		}()
+	}
+
+	if _, err := systemd.Notify("READY=1\nSTATUS=serving on " + strings.Join(addrs, ", ")); err != nil {
+		logrus.WithError(err).Warn("notify systemd failed")
+	}
+	watchdog, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go systemd.Watchdog(watchdog, interval)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-errc:
+			logrus.Fatalf("start server failed, casuse: %+v", err)
+		case <-hup:
+			reload.reload()
+		case s := <-sig:
+			logrus.WithField("signal", s.String()).Info("shutdown requested")
+			_, _ = systemd.Notify("STOPPING=1")
+			break wait
+		}
+	}
+
+	interrupted := shutdown(srv, h3, transfers, viper.GetDuration(OptionShutdownGrace), sig)
+	if keys != nil {
+		if err := keys.Flush(); err != nil {
+			logrus.Errorf("flush api key usage failed, casuse: %+v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logrus.Errorf("flush traces failed, casuse: %+v", err)
 	}
+	logrus.WithField("interrupted", interrupted).Info("shutdown complete")
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net/http"
+)
+
+// withH2C serves HTTP/2 to clients and proxies that speak it without TLS, with prior knowledge or
+// by upgrading, TLS connections negotiate HTTP/2 themselves
+func withH2C(h http.Handler) http.Handler {
+	h2 := h2c.NewHandler(h, &http2.Server{})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		h2.ServeHTTP(w, req)
+	})
+}
+
+// newHTTP3Server returns the HTTP/3 server of h, tlsConf is the one of the TLS listeners,
+// so that certificate reloads and client certificates apply to QUIC too
+func newHTTP3Server(h http.Handler, tlsConf *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:   h,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConf),
+	}
+}
+
+// withAltSvc advertises the HTTP/3 server on responses over TLS, browsers only switch from https
+func withAltSvc(h http.Handler, h3 *http3.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && req.ProtoMajor < 3 {
+			// fails until the QUIC listener is served, there is nothing to advertise until then
+			_ = h3.SetQuicHeaders(w.Header())
+		}
+		h.ServeHTTP(w, req)
+	})
+}
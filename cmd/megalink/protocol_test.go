@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"github.com/mocukie/megalink/pkg/tlsutil"
+	"github.com/mocukie/megalink/server"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProtocols(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	content := make([]byte, 64<<10)
+	rand.Read(content)
+	client, link := megatest.NewClient("file.bin", content)
+	h, err := server.New(server.Options{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/dl/" + link
+
+	plain := httptest.NewServer(withH2C(h))
+	defer plain.Close()
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	dir := t.TempDir()
+	certFile, keyFile, err := tlsutil.SelfSigned(dir, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	h3 := newHTTP3Server(h, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go h3.Serve(udp)
+	defer h3.Close()
+	h3Client := &http.Client{Transport: &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	for _, tc := range []struct {
+		name   string
+		client *http.Client
+		url    string
+		proto  int
+	}{
+		{"HTTP/1.1", plain.Client(), plain.URL, 1},
+		{"h2c", h2c, plain.URL, 2},
+		{"HTTP/3", h3Client, "https://" + udp.LocalAddr().String(), 3},
+	} {
+		for _, rg := range []struct {
+			header, contentRange string
+			code, s, e           int
+		}{
+			{"", "", 200, 0, len(content)},
+			{"bytes=10-99", fmt.Sprintf("bytes 10-99/%d", len(content)), 206, 10, 100},
+		} {
+			req, _ := http.NewRequest(http.MethodGet, tc.url+path, nil)
+			if rg.header != "" {
+				req.Header.Set("Range", rg.header)
+			}
+			resp, err := tc.client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %q: %v", tc.name, rg.header, err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s %q: %v", tc.name, rg.header, err)
+			}
+			if resp.ProtoMajor != tc.proto {
+				t.Errorf("%s %q: served over %s", tc.name, rg.header, resp.Proto)
+			}
+			if resp.StatusCode != rg.code || resp.Header.Get("Content-Range") != rg.contentRange {
+				t.Errorf("%s %q: got %d %q", tc.name, rg.header, resp.StatusCode, resp.Header.Get("Content-Range"))
+			}
+			if !bytes.Equal(body, content[rg.s:rg.e]) {
+				t.Errorf("%s %q: content mismatch", tc.name, rg.header)
+			}
+		}
+	}
+
+	secure := httptest.NewTLSServer(withAltSvc(h, h3))
+	defer secure.Close()
+	resp, err := secure.Client().Get(secure.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_, port, _ := net.SplitHostPort(udp.LocalAddr().String())
+	if alt := resp.Header.Get("Alt-Svc"); !strings.Contains(alt, `h3=":`+port+`"`) {
+		t.Errorf("Alt-Svc %q does not advertise HTTP/3", alt)
+	}
+}
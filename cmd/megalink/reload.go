@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/mocukie/megalink/pkg/logging"
+	"github.com/mocukie/megalink/pkg/policy"
+	"github.com/mocukie/megalink/pkg/systemd"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/pkg/tlsutil"
+	"github.com/mocukie/megalink/web/ratelimit"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// editors save files in several steps, a reload waits for the writes to settle
+const reloadDelay = 500 * time.Millisecond
+
+// options a reload applies, every other option needs a restart
+var reloadable = map[string]bool{
+	OptionLogLevel:         true,
+	OptionLogFormat:        true,
+	OptionLogOutput:        true,
+	OptionLimitRate:        true,
+	OptionLimitBurst:       true,
+	OptionLimitStreams:     true,
+	OptionThrottleGlobal:   true,
+	OptionThrottleConn:     true,
+	OptionThrottleSchedule: true,
+	OptionTLSCert:          true,
+	OptionTLSKey:           true,
+	OptionTLSSelfSigned:    true,
+	OptionTLSHosts:         true,
+	OptionTLSDir:           true,
+}
+
+// reloader applies a changed config file to the running server, downloads in flight are kept
+type reloader struct {
+	file  string // --config, empty to search the config paths again
+	flags *pflag.FlagSet
+
+	limiter *ratelimit.Limiter
+	bw      *throttle.Throttle
+	rules   *policy.Engine   // nil without a policy file
+	cert    *tlsutil.KeyPair // nil without TLS
+
+	mu      sync.Mutex
+	running map[string]interface{} // options in effect
+}
+
+func newReloader(file string, v *viper.Viper, flags *pflag.FlagSet) *reloader {
+	r := &reloader{file: file, flags: flags, running: make(map[string]interface{})}
+	flags.VisitAll(func(f *pflag.Flag) {
+		r.running[f.Name] = optionValue(v, f)
+	})
+	return r
+}
+
+// watch reloads whenever the config file changes
+func (r *reloader) watch(conf *viper.Viper) {
+	var timer *time.Timer
+	conf.OnConfigChange(func(fsnotify.Event) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(reloadDelay, r.reload)
+	})
+	conf.WatchConfig()
+}
+
+// reload reads the config again, a broken config is reported and changes nothing
+func (r *reloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = systemd.Notify("RELOADING=1")
+	defer systemd.Notify("READY=1")
+
+	v := viper.New()
+	bindOptions(v, r.flags)
+	conf, err := readConfig(r.file, r.flags)
+	if err == nil && conf != nil {
+		err = v.MergeConfigMap(conf.AllSettings())
+	}
+	if err == nil {
+		err = validateConfig(v)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("config reload failed, keep running config")
+		return
+	}
+
+	// logging first, so that the rest is reported with it
+	if err = logging.Setup(logConfig(v)); err != nil {
+		logrus.WithError(err).Error("apply log options failed, keep previous logging")
+	}
+	r.limiter.SetConfig(limitConfig(v))
+	if base, windows, err := parseThrottle(v); err == nil {
+		r.bw.SetDefaults(base, windows)
+	}
+	if r.rules != nil {
+		if err = r.rules.Reload(); err != nil {
+			logrus.WithError(err).Warn("policy reload failed, keep previous rules")
+		}
+	}
+	// TLS can't be turned on or off without a restart, but certificates can be swapped,
+	// the options of a certificate that failed to load stay pending so the next reload retries it
+	tlsLive := r.cert != nil && tlsEnabled(v)
+	tlsApplied := tlsLive
+	if tlsLive {
+		certFile, keyFile, err := tlsFiles(v)
+		if err == nil {
+			err = r.cert.SetFiles(certFile, keyFile)
+		}
+		if err != nil {
+			logrus.WithError(err).Error("certificate reload failed, keep previous certificate")
+			tlsApplied = false
+		}
+	}
+
+	var restart []string
+	r.flags.VisitAll(func(f *pflag.Flag) {
+		if cliOptions[f.Name] {
+			return
+		}
+		val := optionValue(v, f)
+		if reflect.DeepEqual(val, r.running[f.Name]) {
+			return
+		}
+		tls := strings.HasPrefix(f.Name, "tls.")
+		switch {
+		case !reloadable[f.Name] || tls && !tlsLive:
+			restart = append(restart, f.Name)
+		case !tls || tlsApplied:
+			r.running[f.Name] = val
+		}
+	})
+
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if conf != nil {
+		entry = entry.WithField("file", conf.ConfigFileUsed())
+	}
+	entry.Info("config reloaded")
+	if len(restart) != 0 {
+		logrus.WithField("options", strings.Join(restart, ",")).Warn("changed options take effect after a restart")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/pkg/tlsutil"
+	"github.com/mocukie/megalink/web/ratelimit"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+)
+
+func TestReload(t *testing.T) {
+	flags := testFlags()
+	flags.String(OptionThrottleGlobal, "0", "")
+	flags.String(OptionThrottleConn, "0", "")
+	flags.StringSlice(OptionThrottleSchedule, nil, "")
+	flags.Int(OptionDlConns, 1, "")
+	flags.Int64(OptionDlSegment, 1<<20, "")
+	flags.String(OptionLogLevel, "info", "")
+	flags.String(OptionLogFormat, "logfmt", "")
+	flags.String(OptionLogOutput, "stderr", "")
+
+	file := writeConfig(t, "megalink.yaml", "addr: 127.0.0.1:8080\nthrottle:\n  global: 1M\n")
+	conf, err := readConfig(file, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	bindOptions(v, flags)
+	_ = v.MergeConfigMap(conf.AllSettings())
+
+	base, windows, err := parseThrottle(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(file, v, flags)
+	r.limiter, r.bw = ratelimit.New(limitConfig(v)), throttle.New(base, windows)
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	// a broken file changes nothing
+	if err = ioutil.WriteFile(file, []byte("throttle:\n  global: fast\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.reload()
+	if l, _ := r.bw.Limits(); l.Global != 1<<20 {
+		t.Errorf("limits changed by a broken config: %+v", l)
+	}
+	if e := hook.LastEntry(); e == nil || e.Level != logrus.ErrorLevel {
+		t.Errorf("broken config not reported: %v", e)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("addr: 0.0.0.0:8080\nthrottle:\n  global: 2M\nlimit:\n  streams: 1\nlog:\n  level: debug\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hook.Reset()
+	r.reload()
+	if l, _ := r.bw.Limits(); l.Global != 2<<20 {
+		t.Errorf("bandwidth not reloaded: %+v", l)
+	}
+	if !r.limiter.Enabled() {
+		t.Error("stream limit not reloaded")
+	}
+	if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+		t.Error("log level not reloaded")
+	}
+
+	var restart string
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel {
+			restart, _ = e.Data["options"].(string)
+		}
+	}
+	if restart != OptionServerAddr {
+		t.Errorf("options needing a restart: got %q, want %q", restart, OptionServerAddr)
+	}
+
+	// still pending until a restart
+	hook.Reset()
+	r.reload()
+	if e := hook.LastEntry(); e == nil || !strings.Contains(e.Message, "restart") {
+		t.Errorf("pending restart not reported again: %v", e)
+	}
+}
+
+func TestReloadCertFailure(t *testing.T) {
+	flags := testFlags()
+	flags.String(OptionTLSCert, "", "")
+	flags.String(OptionTLSKey, "", "")
+	flags.Bool(OptionTLSSelfSigned, false, "")
+	flags.String(OptionThrottleGlobal, "0", "")
+	flags.String(OptionThrottleConn, "0", "")
+	flags.Int(OptionDlConns, 1, "")
+	flags.Int64(OptionDlSegment, 1<<20, "")
+	flags.String(OptionLogLevel, "info", "")
+	flags.String(OptionLogFormat, "logfmt", "")
+	flags.String(OptionLogOutput, "stderr", "")
+
+	certFile, keyFile, err := tlsutil.SelfSigned(t.TempDir(), []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFile, newKey, err := tlsutil.SelfSigned(t.TempDir(), []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writeConfig(t, "megalink.yaml", "tls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n")
+	conf, err := readConfig(file, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	bindOptions(v, flags)
+	_ = v.MergeConfigMap(conf.AllSettings())
+	r := newReloader(file, v, flags)
+	r.limiter, r.bw = ratelimit.New(limitConfig(v)), throttle.New(throttle.Limits{}, nil)
+	if r.cert, err = tlsutil.LoadKeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	// the new certificate is not there yet, e.g. renewed by a job that failed
+	missing := newFile + ".missing"
+	if err = ioutil.WriteFile(file, []byte("tls:\n  cert: "+missing+"\n  key: "+newKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		hook.Reset()
+		r.reload()
+		if r.running[OptionTLSCert] != certFile {
+			t.Errorf("reload #%d: running certificate %v, want %s", i, r.running[OptionTLSCert], certFile)
+		}
+		var failed bool
+		for _, e := range hook.AllEntries() {
+			failed = failed || e.Level == logrus.ErrorLevel && strings.Contains(e.Message, "certificate")
+		}
+		if !failed {
+			t.Errorf("reload #%d: certificate failure not reported", i)
+		}
+	}
+
+	if err = ioutil.WriteFile(file, []byte("tls:\n  cert: "+newFile+"\n  key: "+newKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hook.Reset()
+	r.reload()
+	if r.running[OptionTLSCert] != newFile || r.running[OptionTLSKey] != newKey {
+		t.Errorf("running certificate %v %v, want %s %s", r.running[OptionTLSCert], r.running[OptionTLSKey], newFile, newKey)
+	}
+	for _, e := range hook.AllEntries() {
+		if e.Level <= logrus.WarnLevel {
+			t.Errorf("fixed certificate: %s %v", e.Message, e.Data)
+		}
+	}
+}
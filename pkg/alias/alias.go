@@ -0,0 +1,163 @@
+package alias
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("alias not found")
+	ErrInvalidName = errors.New("invalid alias name")
+
+	nameRegex = regexp.MustCompile(`^[a-zA-Z\d._-]{1,64}$`)
+)
+
+// Entry points to a MEGA file or folder link (handle!key), Handle selects a file inside a folder link
+type Entry struct {
+	Name    string    `json:"name"`
+	Link    string    `json:"link"`
+	Handle  string    `json:"handle,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Store keeps aliases in a JSON file, changes made by other processes (e.g. the CLI)
+// are picked up by the next read. The file is small, so it is compared by content,
+// a modification time may not change between two quick writes.
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]Entry
+	sum     [sha256.Size]byte
+}
+
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, entries: make(map[string]Entry)}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func ValidName(name string) bool {
+	return nameRegex.MatchString(name)
+}
+
+func (s *Store) refresh() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.entries, s.sum = make(map[string]Entry), [sha256.Size]byte{}
+		return nil
+	} else if err != nil {
+		return errorx.Decorate(err, "read alias file failed")
+	}
+	sum := sha256.Sum256(data)
+	if sum == s.sum {
+		return nil
+	}
+
+	var list []Entry
+	if err = json.Unmarshal(data, &list); err != nil {
+		return errorx.Decorate(err, "decode alias file failed")
+	}
+	entries := make(map[string]Entry, len(list))
+	for _, e := range list {
+		entries[e.Name] = e
+	}
+	s.entries, s.sum = entries, sum
+	return nil
+}
+
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return errorx.Decorate(err, "encode aliases failed")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".aliases-*")
+	if err != nil {
+		return errorx.Decorate(err, "create alias file failed")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return errorx.Decorate(err, "write alias file failed")
+	}
+	s.sum = sha256.Sum256(data)
+	return nil
+}
+
+func (s *Store) list() []Entry {
+	list := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (s *Store) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s.list(), nil
+}
+
+func (s *Store) Get(name string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return Entry{}, err
+	}
+	e, ok := s.entries[name]
+	if !ok {
+		return Entry{}, errorx.Decorate(ErrNotFound, name)
+	}
+	return e, nil
+}
+
+// Set creates or replaces an alias
+func (s *Store) Set(e Entry) (Entry, error) {
+	if !ValidName(e.Name) {
+		return Entry{}, errorx.Decorate(ErrInvalidName, e.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return Entry{}, err
+	}
+	e.Updated = time.Now().UTC().Truncate(time.Second)
+	s.entries[e.Name] = e
+	return e, s.save()
+}
+
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if _, ok := s.entries[name]; !ok {
+		return errorx.Decorate(ErrNotFound, name)
+	}
+	delete(s.entries, name)
+	return s.save()
+}
@@ -0,0 +1,47 @@
+package alias
+
+import (
+	"github.com/mocukie/megalink/pkg/errutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aliases.json")
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Set(Entry{Name: "team", Link: "abcdefgh!0123456789012345678901"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Set(Entry{Name: "bad/name"}); errutil.Cause(err) != ErrInvalidName {
+		t.Errorf("invalid name: got %v", err)
+	}
+
+	// another process, e.g. the CLI, updates the file, keeping its size and modification time
+	st, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := Open(file)
+	if _, err = other.Set(Entry{Name: "team", Link: "ijklmnop!0123456789012345678901"}); err != nil {
+		t.Fatal(err)
+	}
+	if st2, _ := os.Stat(file); st2.Size() != st.Size() {
+		t.Fatalf("size changed from %d to %d", st.Size(), st2.Size())
+	}
+	_ = os.Chtimes(file, st.ModTime(), st.ModTime())
+
+	e, err := s.Get("team")
+	if err != nil || e.Link != "ijklmnop!0123456789012345678901" {
+		t.Errorf("reload: got %+v, %v", e, err)
+	}
+	if err = s.Delete("team"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("team"); errutil.Cause(err) != ErrNotFound {
+		t.Errorf("deleted: got %v", err)
+	}
+}
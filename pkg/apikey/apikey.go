@@ -0,0 +1,416 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	secretPrefix  = "mlk_"
+	flushInterval = 30 * time.Second
+	dayLayout     = "2006-01-02"
+	monthLayout   = "2006-01"
+)
+
+var (
+	ErrNotFound       = errors.New("api key not found")
+	ErrDailyQuota     = errors.New("daily transfer quota of the api key exceeded")
+	ErrMonthlyQuota   = errors.New("monthly transfer quota of the api key exceeded")
+	ErrTooManyStreams = errors.New("too many concurrent downloads for the api key")
+	ErrScope          = errors.New("link is outside of the api key scopes")
+)
+
+// Limits of a key, zero values are unlimited
+type Limits struct {
+	Daily      int64 `json:"daily,omitempty"`   // bytes per UTC day
+	Monthly    int64 `json:"monthly,omitempty"` // bytes per UTC month
+	MaxStreams int   `json:"max_streams,omitempty"`
+}
+
+type Key struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Hash string `json:"hash"` // hex sha256 of the secret, the secret itself is never stored
+	Limits
+	// MEGA handles, of files or of the folders they are shared in, the key may download, empty for any
+	Scopes []string `json:"scopes,omitempty"`
+	// identities of TLS client certificates which authenticate as the key, see auth.CertIdentity
+	Certs   []string  `json:"certs,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+	Requests   int64  `json:"requests"`
+	Streams    int    `json:"streams"` // in flight, not persisted
+}
+
+func (u *Usage) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(dayLayout); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format(monthLayout); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// Store keeps keys in a JSON file, changes made by other processes (e.g. the CLI) are picked up
+// by the next read. The file is compared by content, a revocation may not change its modification
+// time. Usage is kept in memory and written to <file>.usage from time to time.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	keys    map[string]Key
+	sum     [sha256.Size]byte
+	usage   map[string]*Usage
+	dirty   bool
+	flushed time.Time
+}
+
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]Key), usage: make(map[string]*Usage)}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.usagePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errorx.Decorate(err, "read usage file failed")
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &s.usage); err != nil {
+			return nil, errorx.Decorate(err, "decode usage file failed")
+		}
+	}
+	for _, u := range s.usage {
+		u.Streams = 0
+	}
+	s.flushed = time.Now()
+	return s, nil
+}
+
+func (s *Store) usagePath() string {
+	return s.path + ".usage"
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) refresh() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.keys, s.sum = make(map[string]Key), [sha256.Size]byte{}
+		return nil
+	} else if err != nil {
+		return errorx.Decorate(err, "read key file failed")
+	}
+	sum := sha256.Sum256(data)
+	if sum == s.sum {
+		return nil
+	}
+
+	var list []Key
+	if err = json.Unmarshal(data, &list); err != nil {
+		return errorx.Decorate(err, "decode key file failed")
+	}
+	keys := make(map[string]Key, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.keys, s.sum = keys, sum
+	return nil
+}
+
+// writeFile replaces path with v as JSON, which it returns
+func writeFile(path string, v interface{}) (data []byte, err error) {
+	data, err = json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, errorx.Decorate(err, "encode %s failed", filepath.Base(path))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return nil, errorx.Decorate(err, "create %s failed", filepath.Base(path))
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err == nil {
+		if _, err = tmp.Write(data); err == nil {
+			err = tmp.Close()
+		}
+	}
+	if err != nil {
+		tmp.Close()
+	} else {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "write %s failed", filepath.Base(path))
+	}
+	return data, nil
+}
+
+func (s *Store) save() error {
+	data, err := writeFile(s.path, s.list())
+	if err != nil {
+		return err
+	}
+	s.sum = sha256.Sum256(data)
+	return nil
+}
+
+func (s *Store) list() []Key {
+	list := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name || list[i].Name == list[j].Name && list[i].ID < list[j].ID
+	})
+	return list
+}
+
+func (s *Store) List() ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s.list(), nil
+}
+
+func (s *Store) Get(id string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return Key{}, err
+	}
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, errorx.Decorate(ErrNotFound, id)
+	}
+	return k, nil
+}
+
+// Create adds a key and returns its secret, which can't be recovered later
+func (s *Store) Create(name string, l Limits, scopes, certs []string) (Key, string, error) {
+	raw := make([]byte, 30)
+	if _, err := rand.Read(raw); err != nil {
+		return Key{}, "", errorx.Decorate(err, "generate key failed")
+	}
+	secret := secretPrefix + base64.RawURLEncoding.EncodeToString(raw[6:])
+	k := Key{
+		ID:      base64.RawURLEncoding.EncodeToString(raw[:6]),
+		Name:    name,
+		Hash:    hashSecret(secret),
+		Limits:  l,
+		Scopes:  scopes,
+		Certs:   certs,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return Key{}, "", err
+	}
+	s.keys[k.ID] = k
+	if err := s.save(); err != nil {
+		return Key{}, "", err
+	}
+	return k, secret, nil
+}
+
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if _, ok := s.keys[id]; !ok {
+		return errorx.Decorate(ErrNotFound, id)
+	}
+	delete(s.keys, id)
+	return s.save()
+}
+
+// Authenticate returns the key of secret
+func (s *Store) Authenticate(secret string) (Key, bool) {
+	hash := []byte(hashSecret(secret))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return Key{}, false
+	}
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash, []byte(k.Hash)) == 1 {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// ByCert returns the key bound to a client certificate identity
+func (s *Store) ByCert(identity string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return Key{}, false
+	}
+	for _, k := range s.keys {
+		for _, c := range k.Certs {
+			if c == identity {
+				return k, true
+			}
+		}
+	}
+	return Key{}, false
+}
+
+// CheckScope checks the link handles against the key scopes, no handles pass
+func (s *Store) CheckScope(id string, handles ...string) error {
+	k, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if len(k.Scopes) == 0 || len(handles) == 0 {
+		return nil
+	}
+	for _, h := range handles {
+		for _, scope := range k.Scopes {
+			if h == scope {
+				return nil
+			}
+		}
+	}
+	return errorx.Decorate(ErrScope, "key %s, handles %v", id, handles)
+}
+
+// usage must be called with s.mu held
+func (s *Store) usageOf(id string, now time.Time) *Usage {
+	u, ok := s.usage[id]
+	if !ok {
+		u = &Usage{}
+		s.usage[id] = u
+	}
+	u.roll(now)
+	return u
+}
+
+func checkQuota(k Key, u *Usage) error {
+	if k.Daily > 0 && u.DayBytes >= k.Daily {
+		return errorx.Decorate(ErrDailyQuota, "key %s", k.ID)
+	}
+	if k.Monthly > 0 && u.MonthBytes >= k.Monthly {
+		return errorx.Decorate(ErrMonthlyQuota, "key %s", k.ID)
+	}
+	return nil
+}
+
+// Transfer is a download accounted to a key
+type Transfer struct {
+	s   *Store
+	key Key
+}
+
+// Begin starts a download of key id, it fails when a quota is used up or the key
+// has too many downloads in flight. Done must be called when the download ends.
+func (s *Store) Begin(id string) (*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, errorx.Decorate(ErrNotFound, id)
+	}
+	u := s.usageOf(id, time.Now())
+	if err := checkQuota(k, u); err != nil {
+		return nil, err
+	}
+	if k.MaxStreams > 0 && u.Streams >= k.MaxStreams {
+		return nil, errorx.Decorate(ErrTooManyStreams, "key %s", id)
+	}
+	u.Streams++
+	u.Requests++
+	s.dirty = true
+	return &Transfer{s: s, key: k}, nil
+}
+
+// Add accounts n bytes sent, it fails once a quota is used up
+func (t *Transfer) Add(n int64) error {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	u := t.s.usageOf(t.key.ID, time.Now())
+	u.DayBytes += n
+	u.MonthBytes += n
+	u.TotalBytes += n
+	t.s.dirty = true
+	if t.key.Daily > 0 && u.DayBytes > t.key.Daily {
+		return errorx.Decorate(ErrDailyQuota, "key %s", t.key.ID)
+	}
+	if t.key.Monthly > 0 && u.MonthBytes > t.key.Monthly {
+		return errorx.Decorate(ErrMonthlyQuota, "key %s", t.key.ID)
+	}
+	return nil
+}
+
+func (t *Transfer) Done() {
+	t.s.mu.Lock()
+	t.s.usageOf(t.key.ID, time.Now()).Streams--
+	due := time.Since(t.s.flushed) >= flushInterval
+	t.s.mu.Unlock()
+	if due {
+		_ = t.s.Flush()
+	}
+}
+
+// Report returns the usage of every key
+func (s *Store) Report() map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	report := make(map[string]Usage, len(s.keys))
+	for id := range s.keys {
+		report[id] = *s.usageOf(id, now)
+	}
+	return report
+}
+
+// Flush writes the usage file if anything changed
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushed = time.Now()
+	if !s.dirty {
+		return nil
+	}
+	for id := range s.usage {
+		if _, ok := s.keys[id]; !ok {
+			delete(s.usage, id)
+		}
+	}
+	if _, err := writeFile(s.usagePath(), s.usage); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
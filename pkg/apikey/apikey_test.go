@@ -0,0 +1,115 @@
+package apikey
+
+import (
+	"github.com/mocukie/megalink/pkg/errutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, secret, err := s.Create("team", Limits{Daily: 100, MaxStreams: 1}, []string{"abcdefgh"}, []string{"backup.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.Authenticate(secret); !ok || got.ID != k.ID {
+		t.Errorf("authenticate: got %+v %v", got, ok)
+	}
+	if _, ok := s.Authenticate(secret + "x"); ok {
+		t.Error("wrong secret authenticated")
+	}
+	if got, ok := s.ByCert("backup.example.com"); !ok || got.ID != k.ID {
+		t.Errorf("by cert: got %+v %v", got, ok)
+	}
+	if _, ok := s.ByCert("other.example.com"); ok {
+		t.Error("unbound cert matched")
+	}
+
+	if err = s.CheckScope(k.ID, "abcdefgh", "ijklmnop"); err != nil {
+		t.Errorf("in scope: %v", err)
+	}
+	if err = s.CheckScope(k.ID, "ijklmnop"); errutil.Cause(err) != ErrScope {
+		t.Errorf("out of scope: got %v", err)
+	}
+
+	tr, err := s.Begin(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Begin(k.ID); errutil.Cause(err) != ErrTooManyStreams {
+		t.Errorf("second stream: got %v", err)
+	}
+	if err = tr.Add(60); err != nil {
+		t.Errorf("within quota: %v", err)
+	}
+	if err = tr.Add(60); errutil.Cause(err) != ErrDailyQuota {
+		t.Errorf("over quota: got %v", err)
+	}
+	tr.Done()
+	if _, err = s.Begin(k.ID); errutil.Cause(err) != ErrDailyQuota {
+		t.Errorf("quota used up: got %v", err)
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// usage survives a restart
+	s, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := s.Report()[k.ID]
+	if u.DayBytes != 120 || u.TotalBytes != 120 || u.Requests != 1 || u.Streams != 0 {
+		t.Errorf("reopened usage: %+v", u)
+	}
+
+	if err = s.Delete(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Begin(k.ID); errutil.Cause(err) != ErrNotFound {
+		t.Errorf("deleted: got %v", err)
+	}
+}
+
+func TestRevokeSameModTime(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, secret, err := s.Create("team", Limits{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Authenticate(secret); !ok {
+		t.Fatal("new key not authenticated")
+	}
+
+	// the CLI revokes the key within the modification time granularity of the file system
+	st, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Delete(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(file, st.ModTime(), st.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Authenticate(secret); ok {
+		t.Error("revoked key still authenticated")
+	}
+	if _, err = s.Begin(k.ID); errutil.Cause(err) != ErrNotFound {
+		t.Errorf("revoked key: got %v", err)
+	}
+}
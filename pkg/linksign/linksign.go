@@ -0,0 +1,208 @@
+package linksign
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	version = 1
+	// bounds the memory of a use, a download scattering more ranges takes the next use
+	maxSpans = 64
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid link token")
+	ErrExpired      = errors.New("link token expired")
+	ErrUsedUp       = errors.New("link token has no uses left")
+	ErrIPMismatch   = errors.New("link token is bound to another client")
+
+	b64 = base64.RawURLEncoding
+)
+
+// Claims is the content of a token, Link is the MEGA link (handle!key) the token stands for
+type Claims struct {
+	ID      string `json:"id"`
+	Link    string `json:"l"`
+	Handle  string `json:"h,omitempty"` // file handle inside a folder link
+	Expiry  int64  `json:"e,omitempty"`
+	MaxUses int    `json:"u,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+// Signer issues opaque tokens, the claims are AES-CTR encrypted then HMAC-SHA256 authenticated
+// with keys derived from the server secret. Use counts live in memory only.
+type Signer struct {
+	block  cipher.Block
+	macKey []byte
+
+	mu   sync.Mutex
+	uses map[string]*useCount
+}
+
+type useCount struct {
+	n      int
+	expiry int64
+	// bytes sent under the current use, sorted and merged
+	sent []Span
+}
+
+// Span is the byte range [Start, End) of the file a download sends
+type Span struct {
+	Start, End int64
+}
+
+func derive(secret []byte, label string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+func NewSigner(secret []byte) (*Signer, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("linksign: empty secret")
+	}
+	block, err := aes.NewCipher(derive(secret, "megalink link encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		block:  block,
+		macKey: derive(secret, "megalink link authentication"),
+		uses:   make(map[string]*useCount),
+	}, nil
+}
+
+func (s *Signer) mac(data []byte) []byte {
+	m := hmac.New(sha256.New, s.macKey)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// Issue fills a random ID and returns the token of c
+func (s *Signer) Issue(c *Claims) (string, error) {
+	id := make([]byte, 9)
+	if _, err := rand.Read(id); err != nil {
+		return "", errorx.Decorate(err, "generate token id failed")
+	}
+	c.ID = b64.EncodeToString(id)
+
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return "", errorx.Decorate(err, "encode claims failed")
+	}
+
+	buf := make([]byte, 1+aes.BlockSize+len(plain))
+	buf[0] = version
+	iv := buf[1 : 1+aes.BlockSize]
+	if _, err = rand.Read(iv); err != nil {
+		return "", errorx.Decorate(err, "generate iv failed")
+	}
+	cipher.NewCTR(s.block, iv).XORKeyStream(buf[1+aes.BlockSize:], plain)
+	return b64.EncodeToString(append(buf, s.mac(buf)...)), nil
+}
+
+// Open authenticates and decrypts token, then checks its expiry
+func (s *Signer) Open(token string, now time.Time) (*Claims, error) {
+	buf, err := b64.DecodeString(token)
+	if err != nil || len(buf) < 1+aes.BlockSize+sha256.Size || buf[0] != version {
+		return nil, errorx.Decorate(ErrInvalidToken, "malformed token")
+	}
+	data, sum := buf[:len(buf)-sha256.Size], buf[len(buf)-sha256.Size:]
+	if !hmac.Equal(sum, s.mac(data)) {
+		return nil, errorx.Decorate(ErrInvalidToken, "bad mac")
+	}
+
+	plain := make([]byte, len(data)-1-aes.BlockSize)
+	cipher.NewCTR(s.block, data[1:1+aes.BlockSize]).XORKeyStream(plain, data[1+aes.BlockSize:])
+	var c Claims
+	if err = json.Unmarshal(plain, &c); err != nil {
+		return nil, errorx.Decorate(ErrInvalidToken, "bad claims")
+	}
+	if c.Expiry != 0 && now.Unix() >= c.Expiry {
+		return nil, errorx.Decorate(ErrExpired, "")
+	}
+	return &c, nil
+}
+
+// Check verifies the client binding of c
+func (c *Claims) Check(ip string) error {
+	if c.IP != "" && c.IP != ip {
+		return errorx.Decorate(ErrIPMismatch, "")
+	}
+	return nil
+}
+
+// Use consumes a use of a token with MaxUses for a download sending spans of the file. Downloads of
+// disjoint parts, e.g. by the connections of a segmented downloader, share a use, a download sending
+// any byte already sent under the current use takes the next one.
+func (s *Signer) Use(c *Claims, spans []Span, now time.Time) error {
+	if c.MaxUses <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, u := range s.uses {
+		if u.expiry != 0 && now.Unix() >= u.expiry {
+			delete(s.uses, id)
+		}
+	}
+	u, ok := s.uses[c.ID]
+	if !ok {
+		u = &useCount{expiry: c.Expiry}
+		s.uses[c.ID] = u
+	}
+	sent := mergeSpans(append(append([]Span(nil), u.sent...), spans...))
+	if u.n == 0 || overlap(u.sent, spans) || len(sent) > maxSpans {
+		if u.n >= c.MaxUses {
+			return errorx.Decorate(ErrUsedUp, "")
+		}
+		u.n++
+		sent = mergeSpans(append([]Span(nil), spans...))
+	}
+	u.sent = sent
+	return nil
+}
+
+func overlap(a, b []Span) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Start < y.End && y.Start < x.End {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeSpans sorts spans and joins the overlapping and adjacent ones, in place
+func mergeSpans(spans []Span) []Span {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+	merged := spans[:0]
+	for _, sp := range spans {
+		if sp.Start >= sp.End {
+			continue
+		}
+		if n := len(merged); n > 0 && sp.Start <= merged[n-1].End {
+			if sp.End > merged[n-1].End {
+				merged[n-1].End = sp.End
+			}
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
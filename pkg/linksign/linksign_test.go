@@ -0,0 +1,99 @@
+package linksign
+
+import (
+	"github.com/mocukie/megalink/pkg/errutil"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	s, err := NewSigner([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c := &Claims{Link: "abcdefgh!0123456789012345678901", Handle: "ijklmnop", Expiry: now.Add(time.Hour).Unix(), MaxUses: 2, IP: "10.0.0.1"}
+	token, err := s.Issue(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Open(token, now)
+	if err != nil || *got != *c {
+		t.Fatalf("open: got %+v, %v, want %+v", got, err, c)
+	}
+	if err = got.Check("10.0.0.2"); errutil.Cause(err) != ErrIPMismatch {
+		t.Errorf("ip binding: got %v", err)
+	}
+	whole := []Span{{0, 100}}
+	for i := 0; i < 2; i++ {
+		if err = s.Use(got, whole, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Use(got, whole, now); errutil.Cause(err) != ErrUsedUp {
+		t.Errorf("max uses: got %v", err)
+	}
+	if _, err = s.Open(token, now.Add(2*time.Hour)); errutil.Cause(err) != ErrExpired {
+		t.Errorf("expiry: got %v", err)
+	}
+
+	tampered := []byte(token)
+	tampered[len(tampered)/2] ^= 1
+	if _, err = s.Open(string(tampered), now); errutil.Cause(err) != ErrInvalidToken {
+		t.Errorf("tampered token: got %v", err)
+	}
+	other, _ := NewSigner([]byte("other"))
+	if _, err = other.Open(token, now); errutil.Cause(err) != ErrInvalidToken {
+		t.Errorf("foreign secret: got %v", err)
+	}
+}
+
+func TestUseSpans(t *testing.T) {
+	s, err := NewSigner([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, c := range []struct {
+		name     string
+		requests [][]Span
+		uses     int
+	}{
+		{"whole file", [][]Span{{{0, 100}}}, 1},
+		{"without the first byte", [][]Span{{{1, 100}}}, 1},
+		{"same range again", [][]Span{{{1, 100}}, {{1, 100}}}, 2},
+		{"resumed", [][]Span{{{0, 40}}, {{40, 100}}}, 1},
+		{"segments", [][]Span{{{50, 75}}, {{0, 25}}, {{75, 100}}, {{25, 50}}}, 1},
+		{"overlapping segments", [][]Span{{{0, 50}}, {{49, 100}}}, 2},
+		{"multipart", [][]Span{{{0, 10}, {20, 30}}, {{10, 20}}, {{25, 26}}}, 2},
+		{"copies", [][]Span{{{0, 100}}, {{0, 1}}, {{1, 100}}, {{0, 100}}}, 3},
+	} {
+		claims := &Claims{MaxUses: 100}
+		if _, err = s.Issue(claims); err != nil {
+			t.Fatal(err)
+		}
+		for _, spans := range c.requests {
+			if err = s.Use(claims, spans, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := s.uses[claims.ID].n; n != c.uses {
+			t.Errorf("%s: %d uses, want %d", c.name, n, c.uses)
+		}
+	}
+
+	// scattered single bytes can't grow the memory of a use without bound
+	claims := &Claims{MaxUses: 100}
+	if _, err = s.Issue(claims); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10*maxSpans; i++ {
+		if err = s.Use(claims, []Span{{2 * i, 2*i + 1}}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u := s.uses[claims.ID]; len(u.sent) > maxSpans || u.n != 10 {
+		t.Errorf("scattered bytes: %d spans, %d uses", len(u.sent), u.n)
+	}
+}
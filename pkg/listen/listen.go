@@ -0,0 +1,202 @@
+package listen
+
+import (
+	"fmt"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/systemd"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	NetworkTCP     = "tcp"
+	NetworkUnix    = "unix"
+	NetworkSystemd = "systemd"
+)
+
+// Spec describes a listener:
+//
+//	host:port, tcp://host:port                 TCP, [::]:port for IPv6
+//	unix:///path?mode=0660&owner=u&group=g     Unix socket, mode and ownership are optional
+//	systemd://, systemd://name                 sockets passed by systemd, all or those with FileDescriptorName=name
+//
+// every kind takes tls=on or tls=off, by default TLS is on when a certificate is configured
+type Spec struct {
+	Network string
+	// host:port, socket path or systemd socket name
+	Address string
+	TLS     *bool
+
+	// Unix sockets only, zero values keep the defaults
+	Mode  os.FileMode
+	Owner string
+	Group string
+}
+
+func Parse(s string) (spec Spec, err error) {
+	if !strings.Contains(s, "://") {
+		s = NetworkTCP + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return spec, errorx.Decorate(err, "invalid listener %q", s)
+	}
+	q := u.Query()
+
+	spec.Network = u.Scheme
+	switch spec.Network {
+	case NetworkTCP:
+		if _, _, err = net.SplitHostPort(u.Host); err != nil {
+			return spec, errorx.Decorate(err, "invalid listener %q", s)
+		}
+		spec.Address = u.Host
+	case NetworkUnix:
+		// unix:///abs/path or unix://./rel/path
+		spec.Address = u.Host + u.Path
+		if spec.Address == "" {
+			return spec, fmt.Errorf("invalid listener %q: missing socket path", s)
+		}
+		if m := q.Get("mode"); m != "" {
+			mode, err := strconv.ParseUint(m, 8, 32)
+			if err != nil || mode > 0777 {
+				return spec, fmt.Errorf("invalid listener %q: mode must be octal like 0660", s)
+			}
+			spec.Mode = os.FileMode(mode)
+		}
+		spec.Owner, spec.Group = q.Get("owner"), q.Get("group")
+	case NetworkSystemd:
+		spec.Address = u.Host
+	default:
+		return spec, fmt.Errorf("invalid listener %q: network must be tcp, unix or systemd", s)
+	}
+
+	switch q.Get("tls") {
+	case "":
+	case "on", "true":
+		on := true
+		spec.TLS = &on
+	case "off", "false":
+		off := false
+		spec.TLS = &off
+	default:
+		return spec, fmt.Errorf("invalid listener %q: tls must be on or off", s)
+	}
+	return spec, nil
+}
+
+// UseTLS tells whether the listener serves TLS, def is used unless tls= is given
+func (s Spec) UseTLS(def bool) bool {
+	if s.TLS != nil {
+		return *s.TLS
+	}
+	return def
+}
+
+func (s Spec) String() string {
+	return s.Network + "://" + s.Address
+}
+
+// Open starts listening, a systemd spec may return several listeners
+func Open(s Spec) ([]net.Listener, error) {
+	switch s.Network {
+	case NetworkUnix:
+		l, err := openUnix(s)
+		if err != nil {
+			return nil, errorx.Decorate(err, "listen on %s failed", s)
+		}
+		return []net.Listener{l}, nil
+	case NetworkSystemd:
+		var list []net.Listener
+		for _, f := range systemd.Files() {
+			if s.Address != "" && f.Name() != s.Address {
+				continue
+			}
+			l, err := net.FileListener(f)
+			if err != nil {
+				return nil, errorx.Decorate(err, "use systemd socket %s failed", f.Name())
+			}
+			list = append(list, l)
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("no socket passed by systemd for %s", s)
+		}
+		return list, nil
+	default:
+		l, err := net.Listen(s.Network, s.Address)
+		if err != nil {
+			return nil, errorx.Decorate(err, "listen on %s failed", s)
+		}
+		return []net.Listener{l}, nil
+	}
+}
+
+func openUnix(s Spec) (net.Listener, error) {
+	// a socket left behind by a crash would make Listen fail
+	if st, err := os.Lstat(s.Address); err == nil && st.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(s.Address)
+	}
+	l, err := net.Listen(NetworkUnix, s.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = setOwnership(s); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setOwnership(s Spec) error {
+	if s.Mode != 0 {
+		if err := os.Chmod(s.Address, s.Mode); err != nil {
+			return err
+		}
+	}
+	if s.Owner == "" && s.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if s.Owner != "" {
+		id, err := lookupID(s.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if s.Group != "" {
+		id, err := lookupID(s.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return os.Chown(s.Address, uid, gid)
+}
+
+// lookupID accepts numeric ids as they are
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,98 @@
+package listen
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	on, off := true, false
+	for i, tc := range []struct {
+		in   string
+		want Spec
+	}{
+		{"127.0.0.1:30303", Spec{Network: NetworkTCP, Address: "127.0.0.1:30303"}},
+		{"tcp://[::]:8080?tls=off", Spec{Network: NetworkTCP, Address: "[::]:8080", TLS: &off}},
+		{"unix:///run/megalink.sock?mode=0660&owner=www-data&group=33", Spec{Network: NetworkUnix, Address: "/run/megalink.sock", Mode: 0660, Owner: "www-data", Group: "33"}},
+		{"unix://./megalink.sock", Spec{Network: NetworkUnix, Address: "./megalink.sock"}},
+		{"systemd://", Spec{Network: NetworkSystemd}},
+		{"systemd://https?tls=on", Spec{Network: NetworkSystemd, Address: "https", TLS: &on}},
+	} {
+		got, err := Parse(tc.in)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if got.Network != tc.want.Network || got.Address != tc.want.Address || got.Mode != tc.want.Mode ||
+			got.Owner != tc.want.Owner || got.Group != tc.want.Group || (got.TLS == nil) != (tc.want.TLS == nil) ||
+			got.TLS != nil && *got.TLS != *tc.want.TLS {
+			t.Errorf("#%d: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"udp://:53", "localhost", "unix://", "unix:///x.sock?mode=999", "tcp://:80?tls=maybe"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+
+	s, _ := Parse(":80")
+	if !s.UseTLS(true) || s.UseTLS(false) {
+		t.Error("default tls not followed")
+	}
+	s, _ = Parse(":80?tls=off")
+	if s.UseTLS(true) {
+		t.Error("tls=off not honored")
+	}
+}
+
+func TestOpenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket modes are not supported on windows")
+	}
+	path := filepath.Join(t.TempDir(), "megalink.sock")
+	spec, err := Parse("unix://" + path + "?mode=0600&owner=" + strconv.Itoa(os.Getuid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale socket is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ls, err := Open(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls[0].Close()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", st.Mode().Perm())
+	}
+
+	go func() {
+		if c, err := ls[0].Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err = Open(Spec{Network: NetworkSystemd, Address: "missing"}); err == nil {
+		t.Error("missing systemd socket accepted")
+	}
+}
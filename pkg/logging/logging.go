@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const Redacted = "REDACTED"
+
+var (
+	// handle!key, handle#key and their escaped forms, as in /dl/ paths and MEGA URLs
+	keyRegex = regexp.MustCompile(`([A-Za-z0-9_-]{8}(?:!|#|%21|%23))[A-Za-z0-9_-]{22,43}`)
+	// bearer material, signed link tokens and ?token=
+	tokenPathRegex  = regexp.MustCompile(`(/s/)[A-Za-z0-9_-]+`)
+	tokenQueryRegex = regexp.MustCompile(`((?:^|[?&])token=)[^&]*`)
+	// the path of a storage server URL is a download token, e.g. in the url.Error of a failed download
+	storageRegex = regexp.MustCompile(`(\.userstorage\.mega\.co\.nz(?::[0-9]+)?)/[^\s"']*`)
+)
+
+// Redact strips MEGA keys and tokens from a request URI, an error or any string which may carry them
+func Redact(s string) string {
+	s = keyRegex.ReplaceAllString(s, "${1}"+Redacted)
+	s = storageRegex.ReplaceAllString(s, "${1}/"+Redacted)
+	s = tokenPathRegex.ReplaceAllString(s, "${1}"+Redacted)
+	return tokenQueryRegex.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+type Config struct {
+	// panic, fatal, error, warn, info, debug or trace
+	Level string
+	// json or logfmt
+	Format string
+	// stderr, stdout or a file path, files are appended to
+	Output string
+}
+
+// log file opened by the last Setup
+var file *os.File
+
+// Setup configures the logrus standard logger, it may be called again to apply a changed config
+func Setup(conf Config) error {
+	level, err := logrus.ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+
+	var formatter logrus.Formatter
+	switch strings.ToLower(conf.Format) {
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	case "logfmt", "":
+		formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	default:
+		return fmt.Errorf("unknown log format %q", conf.Format)
+	}
+
+	var out io.Writer
+	var f *os.File
+	switch conf.Output {
+	case "stderr", "":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		if f, err = os.OpenFile(conf.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640); err != nil {
+			return err
+		}
+		out = f
+	}
+
+	logrus.SetLevel(level)
+	logrus.SetFormatter(formatter)
+	logrus.SetOutput(out)
+	// the logger no longer writes to the previous file once SetOutput returns
+	if file != nil {
+		_ = file.Close()
+	}
+	file = f
+	return nil
+}
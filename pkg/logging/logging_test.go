@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"/dl/abcdefgh!0123456789012345678901", "/dl/abcdefgh!REDACTED"},
+		{"/dl/abcdefgh%210123456789012345678901/file/ijklmnop/a.zip", "/dl/abcdefgh%21REDACTED/file/ijklmnop/a.zip"},
+		{"/dl/abcdefgh!0123456789012345678901234567890123456789012?inline", "/dl/abcdefgh!REDACTED?inline"},
+		{"https://mega.nz/file/abcdefgh#0123456789012345678901234567890123456789012", "https://mega.nz/file/abcdefgh#REDACTED"},
+		{"/api/x?link=https%3A%2F%2Fmega.nz%2Ffolder%2Fabcdefgh%230123456789012345678901", "/api/x?link=https%3A%2F%2Fmega.nz%2Ffolder%2Fabcdefgh%23REDACTED"},
+		{"/s/AQIDBAUGBwgJCgsMDQ4PEA/a.zip", "/s/REDACTED/a.zip"},
+		{"/dl/x?inline&token=t0ken&a=b", "/dl/x?inline&token=REDACTED&a=b"},
+		{"/a/team/a.zip", "/a/team/a.zip"},
+		{`Get "https://gfs270n141.userstorage.mega.co.nz/dl/Xy-Z_1a2b3c/0-999": EOF`, `Get "https://gfs270n141.userstorage.mega.co.nz/REDACTED": EOF`},
+		{"http://gfs208n118.userstorage.mega.co.nz:8080/dl/Xy-Z_1a2b3c then", "http://gfs208n118.userstorage.mega.co.nz:8080/REDACTED then"},
+		{"gfs270n141.userstorage.mega.co.nz: first byte in 240ms", "gfs270n141.userstorage.mega.co.nz: first byte in 240ms"},
+	} {
+		if got := Redact(tc.in); got != tc.want {
+			t.Errorf("Redact(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRedactStorageError(t *testing.T) {
+	const token = "Xy-Z_1a2b3cD4e5F6g7H8"
+	err := errorx.Decorate(&url.Error{
+		Op:  "Get",
+		URL: "https://gfs270n141.userstorage.mega.co.nz/dl/" + token + "/0-999",
+		Err: errors.New("connection reset by peer"),
+	}, "open download failed")
+	for _, s := range []string{err.Error(), fmt.Sprintf("%+v", err)} {
+		got := Redact(s)
+		if strings.Contains(got, token) || !strings.Contains(got, "gfs270n141.userstorage.mega.co.nz/"+Redacted) {
+			t.Errorf("Redact(%q) = %q", s, got)
+		}
+	}
+}
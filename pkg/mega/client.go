@@ -2,11 +2,13 @@ package mega
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"github.com/joomcode/errorx"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -15,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -27,6 +30,26 @@ const (
 type Client struct {
 	seq        uint64
 	httpClient *http.Client
+	apiHook    APIHook
+}
+
+// APIHook is called after every api request with its command, e.g. "f" or "g"
+type APIHook func(cmd string, err error, elapsed time.Duration)
+
+// SetAPIHook must be called before the client is used
+func (c *Client) SetAPIHook(h APIHook) {
+	c.apiHook = h
+}
+
+type apiCommand interface {
+	command() string
+	// node handle the command is about, empty when it is passed as query n
+	handle() string
+}
+
+// SetHTTPClient replaces the client given to NewClient, it must be called before the client is used
+func (c *Client) SetHTTPClient(client *http.Client) {
+	c.httpClient = client
 }
 
 func NewClient(client *http.Client) *Client {
@@ -35,7 +58,24 @@ func NewClient(client *http.Client) *Client {
 	}
 }
 
-func (c *Client) apiSend(query url.Values, request interface{}, response interface{}) error {
+func (c *Client) apiSend(ctx context.Context, query url.Values, request apiCommand, response interface{}) (err error) {
+	handle := request.handle()
+	if handle == "" {
+		handle = query.Get("n")
+	}
+	ctx, span := tracer.Start(ctx, "mega.api "+request.command(), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrCommand.String(request.command()), attrHandle.String(handle)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if c.apiHook != nil {
+		start := time.Now()
+		defer func() {
+			c.apiHook(request.command(), err, time.Since(start))
+		}()
+	}
+
 	body, err := json.Marshal([]interface{}{request})
 	if err != nil {
 
@@ -50,7 +90,12 @@ func (c *Client) apiSend(query url.Values, request interface{}, response interfa
 		reqUrl = fmt.Sprintf("%s?id=%d", ApiURL, seq)
 	}
 
-	resp, err := http.Post(reqUrl, "application/json", bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return errorx.Decorate(err, "create request failed")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return errorx.Decorate(err, "http post net error")
 	}
@@ -93,6 +138,14 @@ type NodesReq struct {
 	CA int    `json:"ca"` //cache?
 }
 
+func (r *NodesReq) command() string {
+	return r.A
+}
+
+func (r *NodesReq) handle() string {
+	return ""
+}
+
 type NodesResp struct {
 	F  []EncryptedNode `json:"f"`
 	SN string          `json:"sn"`
@@ -110,6 +163,10 @@ type EncryptedNode struct {
 }
 
 func (c *Client) OpenPublicFolder(handle, key string) (fm *FM, err error) {
+	return c.OpenPublicFolderContext(context.Background(), handle, key)
+}
+
+func (c *Client) OpenPublicFolderContext(ctx context.Context, handle, key string) (fm *FM, err error) {
 	if len(key) != FolderNodeKeyB64Len {
 		return nil, ErrInvalidKeyLen
 	}
@@ -130,7 +187,7 @@ func (c *Client) OpenPublicFolder(handle, key string) (fm *FM, err error) {
 		C: 1,
 		R: 1,
 	}
-	if err = c.apiSend(url.Values{"n": []string{handle}}, &req, &resp); err != nil {
+	if err = c.apiSend(ctx, url.Values{"n": []string{handle}}, &req, &resp); err != nil {
 		return
 	}
 
@@ -157,13 +214,24 @@ type NodeInfoReq struct {
 	N   string `json:"n,omitempty"` // node handle
 }
 
+func (r *NodeInfoReq) command() string {
+	return r.A
+}
+
+func (r *NodeInfoReq) handle() string {
+	if r.N != "" {
+		return r.N
+	}
+	return r.P
+}
+
 type NodeInfoResp struct {
 	S   int64  `json:"s"`
 	At  string `json:"at"`
 	URL string `json:"g"`
 }
 
-func (c *Client) getFileNodeInfo(ph, handle string, key *NodeKey) (info *NodeInfo, err error) {
+func (c *Client) getFileNodeInfo(ctx context.Context, ph, handle string, key *NodeKey) (info *NodeInfo, err error) {
 	var query = url.Values{}
 	var resp NodeInfoResp
 	var req = NodeInfoReq{
@@ -178,20 +246,27 @@ func (c *Client) getFileNodeInfo(ph, handle string, key *NodeKey) (info *NodeInf
 		query.Set("n", ph)
 	}
 
-	if err = c.apiSend(query, &req, &resp); err != nil {
+	if err = c.apiSend(ctx, query, &req, &resp); err != nil {
 		return
 	}
 
 	info = &NodeInfo{
-		Size: resp.S,
-		URL:  resp.URL,
-		K:    *key,
+		Handle: handle,
+		Size:   resp.S,
+		URL:    resp.URL,
+		K:      *key,
+	}
+	if err = decryptAttr(&info.Attr, resp.At, key.Key); err == nil {
+		info.Timestamp = info.Attr.ModTime()
 	}
-	err = decryptAttr(&info.Attr, resp.At, key.Key)
 	return
 }
 
 func (c *Client) GetPublicFileNodeInfo(publicHandle, nodeHandle string, nodeKey string) (info *NodeInfo, err error) {
+	return c.GetPublicFileNodeInfoContext(context.Background(), publicHandle, nodeHandle, nodeKey)
+}
+
+func (c *Client) GetPublicFileNodeInfoContext(ctx context.Context, publicHandle, nodeHandle string, nodeKey string) (info *NodeInfo, err error) {
 	if len(nodeKey) != FileNodeKeyB64Len {
 		return nil, ErrInvalidKeyLen
 	}
@@ -203,14 +278,25 @@ func (c *Client) GetPublicFileNodeInfo(publicHandle, nodeHandle string, nodeKey
 		return
 	}
 
-	info, err = c.getFileNodeInfo(publicHandle, nodeHandle, &k)
+	info, err = c.getFileNodeInfo(ctx, publicHandle, nodeHandle, &k)
 	return
 }
 
+// Limiter throttles a download, Wait blocks until n more bytes may be handed out
+type Limiter interface {
+	Wait(n int) error
+}
+
 type Download struct {
-	data  io.ReadCloser
-	ctr   cipher.Stream
-	Range struct {
+	data    io.ReadCloser
+	ctr     cipher.Stream
+	limiter Limiter
+	span    trace.Span
+	// totals reported on the span
+	bytes   int64
+	waited  time.Duration
+	decrypt time.Duration
+	Range   struct {
 		S     int64
 		E     int64
 		Total int64
@@ -223,12 +309,65 @@ type Download struct {
 }
 
 func (d *Download) Read(p []byte) (n int, err error) {
+	start := time.Now()
 	n, err = d.data.Read(p)
-	d.ctr.XORKeyStream(p[:n], p[:n])
+	read := time.Now()
+	d.waited += read.Sub(start)
+	if d.ctr != nil {
+		d.ctr.XORKeyStream(p[:n], p[:n])
+		d.decrypt += time.Since(read)
+	}
+	d.bytes += int64(n)
+	if d.limiter != nil && n > 0 {
+		if lerr := d.limiter.Wait(n); lerr != nil {
+			err = lerr
+		}
+	}
 	return
 }
 
+// SetLimiter throttles the decrypted stream, nil removes the limit
+func (d *Download) SetLimiter(l Limiter) {
+	d.limiter = l
+}
+
+// WriteTo decrypts through a pooled buffer, io.Copy would allocate a new one for every download
+func (d *Download) WriteTo(w io.Writer) (n int64, err error) {
+	if d.ctr == nil && d.limiter == nil {
+		if wt, ok := d.data.(io.WriterTo); ok {
+			return wt.WriteTo(w)
+		}
+	}
+
+	bp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bp)
+	buf := *bp
+	for {
+		nr, er := d.Read(buf)
+		if nr > 0 {
+			nw, ew := w.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return n, nil
+		} else if er != nil {
+			return n, er
+		}
+	}
+}
+
 func (d *Download) Close() error {
+	if d.span != nil {
+		d.span.SetAttributes(attrBytes.Int64(d.bytes),
+			attrReadSeconds.Float64(d.waited.Seconds()), attrDecryptSeconds.Float64(d.decrypt.Seconds()))
+		d.span.End()
+	}
 	return d.data.Close()
 }
 
@@ -277,13 +416,25 @@ func NewDownloadOption() DownloadOption {
 var rangeRegex = regexp.MustCompile("^bytes (\\d+)-(\\d+)/(\\d+)$")
 
 func (c *Client) Download(info *NodeInfo, opt DownloadOption) (dl *Download, err error) {
+	return c.DownloadContext(context.Background(), info, opt)
+}
+
+// DownloadContext fetches the node with a single connection, the returned Download must be closed,
+// its trace span ends with it
+func (c *Client) DownloadContext(ctx context.Context, info *NodeInfo, opt DownloadOption) (dl *Download, err error) {
+	ctx, span := tracer.Start(ctx, "mega.download", trace.WithAttributes(attrHandle.String(info.Handle)))
+	defer func() {
+		if err != nil {
+			endSpan(span, err)
+		}
+	}()
 
 	blk, err := aes.NewCipher(info.K.Key)
 	if err != nil {
 		return
 	}
 
-	req, err := http.NewRequest(http.MethodGet, info.URL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
 	if err != nil {
 		return
 	}
@@ -296,12 +447,12 @@ func (c *Client) Download(info *NodeInfo, opt DownloadOption) (dl *Download, err
 		}
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.connect(ctx, req)
 	if err != nil {
 		return
 	}
 
-	dl = new(Download)
+	dl = &Download{span: span}
 	dl.Http.Status, dl.Http.StatusCode, dl.Http.Header = resp.Status, resp.StatusCode, resp.Header
 	if resp.StatusCode >= 400 {
 		resp.Body.Close()
@@ -320,6 +471,7 @@ func (c *Client) Download(info *NodeInfo, opt DownloadOption) (dl *Download, err
 	}
 
 	dl.Range.S, dl.Range.E, dl.Range.Total = int64(s), int64(e), int64(t)
+	span.SetAttributes(attrRange.String(fmt.Sprintf("%d-%d", s, e)))
 	dl.ctr = NewAesCTRStream(blk, info.K.IV, uint64(s))
 	dl.data = resp.Body
 	return
@@ -9,13 +9,12 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"github.com/joomcode/errorx"
-	"unsafe"
+	"math/bits"
 )
 
 var (
-	zeroIV     [aes.BlockSize]byte
-	aesSkipBuf [aes.BlockSize]byte
-	b64        = base64.URLEncoding.WithPadding(base64.NoPadding)
+	zeroIV [aes.BlockSize]byte
+	b64    = base64.URLEncoding.WithPadding(base64.NoPadding)
 )
 
 type ecbDecrypter struct {
@@ -54,7 +53,8 @@ func NewAesCTRStream(blk cipher.Block, iv []byte, off uint64) (ctr cipher.Stream
 	iv = CalcAesCTRIV(iv, off)
 	ctr = cipher.NewCTR(blk, iv)
 	if skip := off % aes.BlockSize; skip > 0 {
-		ctr.XORKeyStream(aesSkipBuf[:skip], aesSkipBuf[:skip])
+		var skipBuf [aes.BlockSize]byte
+		ctr.XORKeyStream(skipBuf[:skip], skipBuf[:skip])
 	}
 	return
 }
@@ -64,14 +64,10 @@ func CalcAesCTRIV(iv []byte, off uint64) []byte {
 		panic("mega.CalcAesCTRIV: IV length must equal block size")
 	}
 
+	// the counter block is a 128-bit big endian integer, so seeking is a single add with carry
 	hi := binary.BigEndian.Uint64(iv)
-	lo := binary.BigEndian.Uint64(iv[8:])
-	for blocks := off / aes.BlockSize; blocks > 0; blocks-- {
-		lo++
-		if lo == 0 {
-			hi++
-		}
-	}
+	lo, carry := bits.Add64(binary.BigEndian.Uint64(iv[8:]), off/aes.BlockSize, 0)
+	hi += carry
 	iv = make([]byte, aes.BlockSize)
 	binary.BigEndian.PutUint64(iv, hi)
 	binary.BigEndian.PutUint64(iv[8:], lo)
@@ -91,8 +87,9 @@ func unpackKeyB64(key string) (aesKey, iv, mac []byte, err error) {
 func unpackKey(key []byte) (aesKey, iv, mac []byte) {
 	var b [40]byte
 	aesKey, iv, mac = b[:16], b[16:32], b[32:]
-	*(*uint64)(unsafe.Pointer(&aesKey[0])) = *(*uint64)(unsafe.Pointer(&key[0])) ^ *(*uint64)(unsafe.Pointer(&key[16]))
-	*(*uint64)(unsafe.Pointer(&aesKey[8])) = *(*uint64)(unsafe.Pointer(&key[8])) ^ *(*uint64)(unsafe.Pointer(&key[24]))
+	for i := range aesKey {
+		aesKey[i] = key[i] ^ key[i+16]
+	}
 	copy(iv, key[16:24])
 	copy(mac, key[24:32])
 	return
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"time"
 
@@ -44,3 +47,75 @@ func TestNewAesCTRStream(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCalcAesCTRIV(t *testing.T) {
+	iv := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}
+	for _, c := range []struct {
+		off  uint64
+		want []byte
+	}{
+		{15, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}},
+		{16, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{32, []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{50 << 30, []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0xc7, 0xff, 0xff, 0xfe}},
+	} {
+		if got := CalcAesCTRIV(iv, c.off); !bytes.Equal(got, c.want) {
+			t.Errorf("off %d: got %x, want %x", c.off, got, c.want)
+		}
+	}
+}
+
+func TestUnpackKey(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	aesKey, iv, mac := unpackKey(key)
+	for i := range aesKey {
+		if aesKey[i] != byte(i)^byte(i+16) {
+			t.Fatalf("aes key %x", aesKey)
+		}
+	}
+	if !bytes.Equal(iv, append(key[16:24:24], make([]byte, 8)...)) || !bytes.Equal(mac, key[24:]) {
+		t.Fatalf("iv %x, mac %x", iv, mac)
+	}
+}
+
+func BenchmarkNewAesCTRStream(b *testing.B) {
+	blk, _ := aes.NewCipher([]byte("!QAZ2wsx1qaz@WSX"))
+	iv := make([]byte, aes.BlockSize)
+	for _, off := range []uint64{0, 1 << 20, 50 << 30, 1 << 50} {
+		b.Run(fmt.Sprintf("off=%d", off), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				NewAesCTRStream(blk, iv, off+7)
+			}
+		})
+	}
+}
+
+type nopReadCloser struct{ io.Reader }
+
+func (nopReadCloser) Close() error { return nil }
+
+// throughput of the decrypting reader once a download is positioned at a large offset
+func BenchmarkDownloadDecrypt(b *testing.B) {
+	blk, _ := aes.NewCipher([]byte("!QAZ2wsx1qaz@WSX"))
+	iv := make([]byte, aes.BlockSize)
+	const size = 4 << 20
+	src := make([]byte, size)
+	for _, off := range []uint64{0, 50 << 30} {
+		b.Run(fmt.Sprintf("off=%d", off), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				dl := &Download{
+					data: nopReadCloser{bytes.NewReader(src)},
+					ctr:  NewAesCTRStream(blk, iv, off),
+				}
+				if _, err := dl.WriteTo(ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
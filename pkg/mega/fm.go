@@ -1,6 +1,7 @@
 package mega
 
 import (
+	"context"
 	"crypto/cipher"
 	"github.com/joomcode/errorx"
 	"path"
@@ -24,14 +25,36 @@ type NodeKey struct {
 }
 
 type Attribute struct {
-	Name string `json:"n"`
+	Name        string `json:"n"`
+	Fingerprint string `json:"c,omitempty"`
+}
+
+// ModTime decodes the file mtime stored in the fingerprint attribute, the fingerprint is
+// 16 bytes of CRC followed by a length prefixed little endian timestamp
+func (a *Attribute) ModTime() int64 {
+	fp, err := b64.DecodeString(a.Fingerprint)
+	if err != nil || len(fp) < 17 {
+		return 0
+	}
+	n := int(fp[16])
+	if n > 8 || len(fp) < 17+n {
+		return 0
+	}
+	var ts int64
+	for i := n - 1; i >= 0; i-- {
+		ts = ts<<8 | int64(fp[17+i])
+	}
+	return ts
 }
 
 type NodeInfo struct {
-	Size int64
-	Attr Attribute
-	K    NodeKey
-	URL  string
+	Handle    string
+	Owner     string
+	Timestamp int64
+	Size      int64
+	Attr      Attribute
+	K         NodeKey
+	URL       string
 }
 
 type Node struct {
@@ -157,11 +180,41 @@ func (fm *FM) LookupPath(p string) *Node {
 	return n
 }
 
+// LookupNamePath resolves a slash separated path of node names, relative to the shared folder
+func (fm *FM) LookupNamePath(p string) *Node {
+	if len(fm.root.Children) == 0 {
+		return nil
+	}
+
+	n := fm.root.Children[0]
+	for _, name := range strings.Split(path.Clean("/" + p)[1:], "/") {
+		if name == "" {
+			continue
+		}
+		var next *Node
+		for _, child := range n.Children {
+			if child.Attr.Name == name {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
 func (fm *FM) Walk(walker func(*Node) bool) {
 	fm.root.Walk(walker)
 }
 
 func (fm *FM) GetFileNodeInfo(n *Node) (info *NodeInfo, err error) {
+	return fm.GetFileNodeInfoContext(context.Background(), n)
+}
+
+func (fm *FM) GetFileNodeInfoContext(ctx context.Context, n *Node) (info *NodeInfo, err error) {
 	if n.Type != TypeFile {
 		return nil, errorx.Decorate(ErrInvalidNodeType, "")
 	}
@@ -171,6 +224,9 @@ func (fm *FM) GetFileNodeInfo(n *Node) (info *NodeInfo, err error) {
 		return nil, errorx.Decorate(API_ENOENT, "")
 	}
 
-	info, err = fm.client.getFileNodeInfo(fm.handle, n.Handle, &n.K)
+	info, err = fm.client.getFileNodeInfo(ctx, fm.handle, n.Handle, &n.K)
+	if err == nil {
+		info.Owner, info.Timestamp = n.Owner, n.Timestamp
+	}
 	return
 }
@@ -0,0 +1,28 @@
+package mega
+
+import "testing"
+
+func TestAttributeModTime(t *testing.T) {
+	crc := make([]byte, 16)
+	for _, c := range []struct {
+		fp   []byte
+		want int64
+	}{
+		{append(crc, 4, 0x00, 0xe1, 0xf5, 0x05), 100000000},
+		{append(crc, 8, 0x80, 0x1f, 0x6b, 0x5f, 0, 0, 0, 0), 1600855936},
+		{append(crc, 5, 0x80, 0x1f, 0x6b, 0x5f, 0x01), 1<<32 + 1600855936},
+		{append(crc, 0), 0},
+		{append(crc, 9, 1, 2, 3, 4, 5, 6, 7, 8, 9), 0},
+		{append(crc, 4, 1, 2), 0},
+		{crc, 0},
+		{nil, 0},
+	} {
+		a := Attribute{Fingerprint: b64.EncodeToString(c.fp)}
+		if got := a.ModTime(); got != c.want {
+			t.Errorf("ModTime(%x) = %d, want %d", c.fp, got, c.want)
+		}
+	}
+	if got := (&Attribute{Fingerprint: "!!"}).ModTime(); got != 0 {
+		t.Errorf("ModTime of invalid base64 = %d", got)
+	}
+}
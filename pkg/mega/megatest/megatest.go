@@ -0,0 +1,161 @@
+// Package megatest fakes the MEGA api and storage servers for tests of the code downloading through them
+package megatest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/mocukie/megalink/pkg/mega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+const (
+	// Handle of the file served by NewClient
+	Handle = "abcdefgh"
+	// FolderHandle of the public folder holding the file
+	FolderHandle = "ijklmnop"
+	// RootHandle of the root node of the folder
+	RootHandle = "qrstuvwx"
+)
+
+var b64 = base64.RawURLEncoding
+
+// RoundTripFunc is a fake transport, e.g. of a MEGA client whose api answers some error code
+type RoundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// File is the file served by NewFileClient
+type File struct {
+	Name    string
+	Content []byte
+	// stored in the fingerprint attribute and as node timestamp when not zero
+	ModTime time.Time
+	// answered by the storage server instead of the content when not zero, e.g. 509 when over quota
+	StorageStatus int
+}
+
+// NewClient returns a MEGA client which finds a single file named name with the given content,
+// link is its megalink style link, Handle!key. Range requests to the storage server are honored.
+func NewClient(name string, content []byte) (client *mega.Client, link string) {
+	client, link, _ = NewFileClient(File{Name: name, Content: content})
+	return
+}
+
+// NewFileClient is NewClient with a modification time, the file is also found as node Handle
+// of the public folder folderLink, FolderHandle!key
+func NewFileClient(f File) (client *mega.Client, link, folderLink string) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k[:24]); err != nil {
+		panic(err)
+	}
+	aesKey := make([]byte, 16)
+	for i := range aesKey {
+		aesKey[i] = k[i] ^ k[i+16]
+	}
+	blk, err := aes.NewCipher(aesKey)
+	if err != nil {
+		panic(err)
+	}
+
+	attr := map[string]string{"n": f.Name}
+	var ts int64
+	if !f.ModTime.IsZero() {
+		ts = f.ModTime.Unix()
+		fp := make([]byte, 17+8)
+		fp[16] = 8
+		binary.LittleEndian.PutUint64(fp[17:], uint64(ts))
+		attr["c"] = b64.EncodeToString(fp)
+	}
+	at := encryptAttr(blk, attr)
+	fileResp := fmt.Sprintf(`[{"s":%d,"at":%q,"g":"https://storage.test/dl/%s"}]`, len(f.Content), at, Handle)
+
+	// the folder master key encrypts the node keys, the root key encrypts nothing here
+	folderKey := make([]byte, 32)
+	if _, err := rand.Read(folderKey); err != nil {
+		panic(err)
+	}
+	master, err := aes.NewCipher(folderKey[:16])
+	if err != nil {
+		panic(err)
+	}
+	rootKey := folderKey[16:]
+	root, err := aes.NewCipher(rootKey)
+	if err != nil {
+		panic(err)
+	}
+	folderResp, _ := json.Marshal(map[string]interface{}{"f": []map[string]interface{}{
+		{"h": RootHandle, "t": mega.TypeFolder, "ts": ts, "k": RootHandle + ":" + encryptKey(master, rootKey),
+			"a": encryptAttr(root, map[string]string{"n": "folder"})},
+		{"h": Handle, "p": RootHandle, "t": mega.TypeFile, "ts": ts, "s": len(f.Content),
+			"k": RootHandle + ":" + encryptKey(master, k), "a": at},
+	}})
+
+	data := make([]byte, len(f.Content))
+	iv := append(append([]byte{}, k[16:24]...), make([]byte, 8)...)
+	cipher.NewCTR(blk, iv).XORKeyStream(data, f.Content)
+
+	client = mega.NewClient(&http.Client{Transport: RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "storage.test" {
+			w := httptest.NewRecorder()
+			if f.StorageStatus != 0 {
+				w.WriteHeader(f.StorageStatus)
+			} else {
+				http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+			}
+			resp := w.Result()
+			resp.Request = req
+			return resp, nil
+		}
+
+		var cmds []struct {
+			A string `json:"a"`
+			P string `json:"p"`
+			N string `json:"n"`
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		_ = json.Unmarshal(body, &cmds)
+		folder := req.URL.Query().Get("n")
+		resp := "[-9]"
+		switch {
+		case len(cmds) != 1:
+			resp = "[-2]"
+		case cmds[0].A == "qbq":
+			resp = "[0]"
+		case cmds[0].A == "f" && folder == FolderHandle:
+			resp = "[" + string(folderResp) + "]"
+		case cmds[0].A == "g" && (cmds[0].P == Handle || cmds[0].N == Handle && folder == FolderHandle):
+			resp = fileResp
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(resp)), Request: req}, nil
+	})})
+	return client, Handle + "!" + b64.EncodeToString(k), FolderHandle + "!" + b64.EncodeToString(folderKey[:16])
+}
+
+func encryptAttr(blk cipher.Block, attr map[string]string) string {
+	b, _ := json.Marshal(attr)
+	b = append([]byte("MEGA"), b...)
+	b = append(b, make([]byte, aes.BlockSize-len(b)%aes.BlockSize)...)
+	cipher.NewCBCEncrypter(blk, make([]byte, aes.BlockSize)).CryptBlocks(b, b)
+	return b64.EncodeToString(b)
+}
+
+// encryptKey encrypts a node key in ECB mode like MEGA does
+func encryptKey(blk cipher.Block, key []byte) string {
+	dst := make([]byte, len(key))
+	for i := 0; i < len(key); i += aes.BlockSize {
+		blk.Encrypt(dst[i:], key[i:])
+	}
+	return b64.EncodeToString(dst)
+}
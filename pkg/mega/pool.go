@@ -0,0 +1,34 @@
+package mega
+
+import (
+	"sync"
+)
+
+const copyBufSize = 64 << 10
+
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufSize)
+		return &b
+	},
+}
+
+// segment buffers are pooled per segment size, a server usually runs with a single size
+var segmentPools sync.Map
+
+func getSegmentBuf(size int64) *[]byte {
+	p, _ := segmentPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+func putSegmentBuf(b *[]byte) {
+	if p, ok := segmentPools.Load(int64(cap(*b))); ok {
+		*b = (*b)[:cap(*b)]
+		p.(*sync.Pool).Put(b)
+	}
+}
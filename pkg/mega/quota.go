@@ -0,0 +1,35 @@
+package mega
+
+import (
+	"context"
+)
+
+type transferQuotaReq struct {
+	A string `json:"a"`
+	S int64  `json:"s"`
+}
+
+func (r *transferQuotaReq) command() string {
+	return r.A
+}
+
+func (r *transferQuotaReq) handle() string {
+	return ""
+}
+
+// QueryTransferQuotaContext asks MEGA whether size more bytes may be downloaded from this IP address,
+// false means the transfer quota is used up
+func (c *Client) QueryTransferQuotaContext(ctx context.Context, size int64) (bool, error) {
+	var code int
+	if err := c.apiSend(ctx, nil, &transferQuotaReq{A: "qbq", S: size}, &code); err != nil {
+		return false, err
+	}
+	// like the official sdk, any error code means the transfer would go over quota
+	return code >= 0, nil
+}
+
+// PingContext checks that the api answers, it sends a transfer quota query
+func (c *Client) PingContext(ctx context.Context) error {
+	_, err := c.QueryTransferQuotaContext(ctx, 0)
+	return err
+}
@@ -0,0 +1,254 @@
+package mega
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultSegmentSize  = 4 << 20
+	segmentFetchRetries = 3
+)
+
+// Segmented splits one download into fixed size ranges that are fetched concurrently
+// and handed back in order, at most Conns segments are buffered at any time
+type Segmented struct {
+	Conns int
+	Size  int64
+}
+
+func (s Segmented) Enabled() bool {
+	return s.Conns > 1
+}
+
+type segmentResult struct {
+	buf       *[]byte
+	data      []byte
+	header    http.Header
+	err       error
+	permanent bool
+}
+
+type segmentReader struct {
+	cancel  context.CancelFunc
+	pending chan chan segmentResult
+	buf     *[]byte
+	cur     []byte
+	err     error
+}
+
+func (r *segmentReader) next() error {
+	r.release()
+	slot, ok := <-r.pending
+	if !ok {
+		return io.EOF
+	}
+	res := <-slot
+	if res.err != nil {
+		return res.err
+	}
+	r.buf, r.cur = res.buf, res.data
+	return nil
+}
+
+func (r *segmentReader) release() {
+	if r.buf != nil {
+		putSegmentBuf(r.buf)
+		r.buf, r.cur = nil, nil
+	}
+}
+
+func (r *segmentReader) Read(p []byte) (n int, err error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n = copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return
+}
+
+// WriteTo hands the decrypted segments to w directly, without an intermediate copy
+func (r *segmentReader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if len(r.cur) == 0 {
+			if r.err == nil {
+				r.err = r.next()
+			}
+			if r.err == io.EOF {
+				return n, nil
+			} else if r.err != nil {
+				return n, r.err
+			}
+			continue
+		}
+		m, e := w.Write(r.cur)
+		n += int64(m)
+		r.cur = r.cur[m:]
+		if e != nil {
+			return n, e
+		}
+	}
+}
+
+func (r *segmentReader) Close() error {
+	r.cancel()
+	r.release()
+	r.err = io.ErrClosedPipe
+	// drain so that no worker stays blocked on its slot
+	go func() {
+		for slot := range r.pending {
+			if res := <-slot; res.buf != nil {
+				putSegmentBuf(res.buf)
+			}
+		}
+	}()
+	return nil
+}
+
+// DownloadSegmented fetches bytes s to e (inclusive, -1 means end of file) of the node with
+// seg.Conns parallel connections, each segment is decrypted on its own
+func (c *Client) DownloadSegmented(info *NodeInfo, s, e int64, seg Segmented, opt DownloadOption) (dl *Download, err error) {
+	return c.DownloadSegmentedContext(context.Background(), info, s, e, seg, opt)
+}
+
+// DownloadSegmentedContext is DownloadSegmented, segment fetches stop when ctx is done
+func (c *Client) DownloadSegmentedContext(ctx context.Context, info *NodeInfo, s, e int64, seg Segmented, opt DownloadOption) (dl *Download, err error) {
+	if e == -1 || e >= info.Size {
+		e = info.Size - 1
+	}
+	if s < 0 || s > e {
+		return nil, errorx.Decorate(HttpStatusErr(http.StatusRequestedRangeNotSatisfiable), "invalid range")
+	}
+	if seg.Conns < 1 {
+		seg.Conns = 1
+	}
+	if seg.Size <= 0 {
+		seg.Size = DefaultSegmentSize
+	}
+
+	blk, err := aes.NewCipher(info.K.Key)
+	if err != nil {
+		return
+	}
+	if opt == nil {
+		opt = NewDownloadOption()
+	}
+
+	ctx, span := tracer.Start(ctx, "mega.download", trace.WithAttributes(attrHandle.String(info.Handle),
+		attrRange.String(fmt.Sprintf("%d-%d", s, e)), attribute.Int("mega.conns", seg.Conns)))
+	ctx, cancel := context.WithCancel(ctx)
+	r := &segmentReader{
+		cancel:  cancel,
+		pending: make(chan chan segmentResult, seg.Conns-1),
+	}
+
+	go func() {
+		defer close(r.pending)
+		for off := s; off <= e; off += seg.Size {
+			end := off + seg.Size - 1
+			if end > e {
+				end = e
+			}
+			slot := make(chan segmentResult, 1)
+			select {
+			case r.pending <- slot:
+			case <-ctx.Done():
+				return
+			}
+			go func(off, end int64) {
+				slot <- c.fetchSegment(ctx, info.URL, blk, info.K.IV, off, end, seg.Size, opt)
+			}(off, end)
+		}
+	}()
+
+	// wait for the first segment, so upstream errors surface before any response is written
+	first := <-r.pending
+	res := <-first
+	if res.err != nil {
+		r.Close()
+		endSpan(span, res.err)
+		return nil, res.err
+	}
+	r.buf, r.cur = res.buf, res.data
+
+	dl = &Download{data: r, span: span}
+	dl.Http.StatusCode, dl.Http.Header = http.StatusOK, res.header
+	if s != 0 || e != info.Size-1 {
+		dl.Http.StatusCode = http.StatusPartialContent
+	}
+	dl.Http.Status = fmt.Sprintf("%d %s", dl.Http.StatusCode, http.StatusText(dl.Http.StatusCode))
+	dl.Range.S, dl.Range.E, dl.Range.Total = s, e, info.Size
+	return
+}
+
+func (c *Client) fetchSegment(ctx context.Context, u string, blk cipher.Block, iv []byte, s, e, size int64, opt DownloadOption) (res segmentResult) {
+	buf := getSegmentBuf(size)
+	for i := 0; i < segmentFetchRetries; i++ {
+		res = c.fetchSegmentOnce(ctx, u, blk, iv, s, e, (*buf)[:e-s+1], opt, i+1)
+		if res.err == nil {
+			res.buf = buf
+			return
+		}
+		if res.permanent || ctx.Err() != nil {
+			break
+		}
+	}
+	putSegmentBuf(buf)
+	return
+}
+
+func (c *Client) fetchSegmentOnce(ctx context.Context, u string, blk cipher.Block, iv []byte, s, e int64, data []byte, opt DownloadOption, attempt int) (res segmentResult) {
+	ctx, span := tracer.Start(ctx, "mega.segment", trace.WithAttributes(
+		attrRange.String(fmt.Sprintf("%d-%d", s, e)), attrAttempt.Int(attempt)))
+	defer func() {
+		endSpan(span, res.err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		res.err = err
+		return
+	}
+	if err = opt.Range(s, e)(req); err != nil {
+		res.err = errorx.Decorate(err, "invalid download option")
+		return
+	}
+
+	resp, err := c.connect(ctx, req)
+	if err != nil {
+		res.err = errorx.Decorate(err, "fetch segment failed")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		res.err, res.permanent = errorx.Decorate(HttpStatusErr(resp.StatusCode), "invalid http status"), true
+		return
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		res.err, res.permanent = errorx.Decorate(HttpStatusErr(resp.StatusCode), "storage server ignored range"), true
+		return
+	}
+
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		res.err = errorx.Decorate(err, "read segment failed")
+		return
+	}
+
+	start := time.Now()
+	NewAesCTRStream(blk, iv, uint64(s)).XORKeyStream(data, data)
+	span.SetAttributes(attrBytes.Int(len(data)), attrDecryptSeconds.Float64(time.Since(start).Seconds()))
+	res.data, res.header = data, resp.Header
+	return
+}
@@ -0,0 +1,54 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDownloadSegmented(t *testing.T) {
+	var plainText = make([]byte, 100_000)
+	var key = []byte("!QAZ2wsx1qaz@WSX")
+	var iv = make([]byte, aes.BlockSize)
+	rand.Read(plainText)
+	rand.Read(iv[:8])
+
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText := make([]byte, len(plainText))
+	cipher.NewCTR(blk, iv).XORKeyStream(cipherText, plainText)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(cipherText))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.Client())
+	info := &NodeInfo{Size: int64(len(plainText)), URL: srv.URL, K: NodeKey{Key: key, IV: iv}}
+	for _, rg := range [][2]int64{{0, -1}, {1, 99_999}, {12_345, 67_890}, {99_999, -1}} {
+		dl, err := c.DownloadSegmented(info, rg[0], rg[1], Segmented{Conns: 4, Size: 1000}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(dl)
+		dl.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plainText[dl.Range.S:dl.Range.E+1]) {
+			t.Errorf("range %v: decrypted content mismatch", rg)
+		}
+	}
+
+	if _, err = c.DownloadSegmented(info, 200_000, -1, Segmented{Conns: 4}, nil); err == nil {
+		t.Error("expect unsatisfiable range error")
+	}
+}
@@ -0,0 +1,54 @@
+package mega
+
+import (
+	"context"
+	"github.com/mocukie/megalink/pkg/errutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// spans are no-ops until a tracer provider is installed with otel.SetTracerProvider
+var tracer = otel.Tracer("github.com/mocukie/megalink/pkg/mega")
+
+const (
+	attrCommand        = attribute.Key("mega.command")
+	attrHandle         = attribute.Key("mega.handle")
+	attrRange          = attribute.Key("mega.range")
+	attrAttempt        = attribute.Key("mega.attempt")
+	attrBytes          = attribute.Key("mega.bytes")
+	attrReadSeconds    = attribute.Key("mega.read_seconds")
+	attrDecryptSeconds = attribute.Key("mega.decrypt_seconds")
+	attrApiErr         = attribute.Key("mega.api_error")
+)
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		if e, ok := errutil.Cause(err).(ApiErr); ok {
+			span.SetAttributes(attrApiErr.Int(int(e)))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// connect sends a storage server request and traces it until the response header,
+// only the host is recorded since the URL path grants access to the file
+func (c *Client) connect(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+	_, span := tracer.Start(ctx, "mega.storage.connect", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.NetPeerNameKey.String(req.URL.Hostname())))
+	if rg := req.Header.Get("Range"); rg != "" {
+		span.SetAttributes(attribute.String("http.request.range", rg))
+	}
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		}
+		endSpan(span, err)
+	}()
+	return c.httpClient.Do(req)
+}
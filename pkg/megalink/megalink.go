@@ -0,0 +1,39 @@
+// Package megalink parses MEGA links, it has no dependencies so that clients of a megalink
+// server can use it as well as the server itself
+package megalink
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	FileLinkRegexs = []*regexp.Regexp{
+		regexp.MustCompile(`^!!([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{43})$`),
+		regexp.MustCompile(`^([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{43})$`),
+	}
+	FolderLinkRegex = regexp.MustCompile(`^([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{22})$`)
+
+	megaURLRegexs = []*regexp.Regexp{
+		regexp.MustCompile(`^https?://mega(?:\.co)?\.nz/#!([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{43})$`),
+		regexp.MustCompile(`^https?://mega(?:\.co)?\.nz/file/([a-zA-Z\d_-]{8})#([a-zA-Z\d_-]{43})$`),
+		regexp.MustCompile(`^https?://mega(?:\.co)?\.nz/folder/([a-zA-Z\d_-]{8})#([a-zA-Z\d_-]{22})(?:/file/([a-zA-Z\d_-]{8}))?$`),
+		regexp.MustCompile(`^!?!?([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{43})$`),
+		regexp.MustCompile(`^([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{22})(?:/file/([a-zA-Z\d_-]{8}))?$`),
+	}
+)
+
+// ParseLink accepts a MEGA URL or a megalink style link (handle!key[/file/handle]),
+// link is handle!key and handle is the file inside a folder link, if any
+func ParseLink(s string) (link, handle string, ok bool) {
+	for _, r := range megaURLRegexs {
+		if g := r.FindStringSubmatch(strings.TrimSpace(s)); len(g) > 0 {
+			link = g[1] + "!" + g[2]
+			if len(g) > 3 {
+				handle = g[3]
+			}
+			return link, handle, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,37 @@
+package megalink
+
+import "testing"
+
+func TestParseLink(t *testing.T) {
+	const (
+		fileKey   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFG"
+		folderKey = "0123456789abcdefghijkl"
+	)
+	for _, c := range []struct {
+		s            string
+		link, handle string
+		ok           bool
+	}{
+		{"https://mega.nz/file/abcdefgh#" + fileKey, "abcdefgh!" + fileKey, "", true},
+		{"http://mega.co.nz/#!abcdefgh!" + fileKey, "abcdefgh!" + fileKey, "", true},
+		{" https://mega.nz/folder/abcdefgh#" + folderKey + "\n", "abcdefgh!" + folderKey, "", true},
+		{"https://mega.nz/folder/abcdefgh#" + folderKey + "/file/ijklmnop", "abcdefgh!" + folderKey, "ijklmnop", true},
+		{"abcdefgh!" + fileKey, "abcdefgh!" + fileKey, "", true},
+		{"!!abcdefgh!" + fileKey, "abcdefgh!" + fileKey, "", true},
+		{"abcdefgh!" + folderKey, "abcdefgh!" + folderKey, "", true},
+		{"abcdefgh!" + folderKey + "/file/ijklmnop", "abcdefgh!" + folderKey, "ijklmnop", true},
+		{"https://mega.nz/file/abcdefgh#short", "", "", false},
+		{"https://example.com/file/abcdefgh#" + fileKey, "", "", false},
+		{"abcdefgh!" + folderKey + "/file/ijk", "", "", false},
+		{"abcdefgh", "", "", false},
+		{"", "", "", false},
+	} {
+		link, handle, ok := ParseLink(c.s)
+		if link != c.link || handle != c.handle || ok != c.ok {
+			t.Errorf("ParseLink(%q) = %q, %q, %v, want %q, %q, %v", c.s, link, handle, ok, c.link, c.handle, c.ok)
+		}
+	}
+	if !FolderLinkRegex.MatchString("abcdefgh!"+folderKey) || FolderLinkRegex.MatchString("abcdefgh!"+fileKey) {
+		t.Error("FolderLinkRegex")
+	}
+}
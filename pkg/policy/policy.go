@@ -0,0 +1,231 @@
+package policy
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/netutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrDenied = errors.New("denied by access policy")
+
+type List struct {
+	Allow []string
+	Deny  []string
+}
+
+type RefererList struct {
+	// host names, *.example.com matches every subdomain
+	Allow []string
+	Deny  []string
+	// requests without Referer, e.g. downloaders, pass the allow list when true
+	AllowEmpty bool `mapstructure:"allow_empty"`
+}
+
+// Rules is the policy file content, deny entries win over allow entries and
+// a non-empty allow list rejects everything it doesn't list
+type Rules struct {
+	// MEGA node handles, of the file and of the folder it is shared in
+	Handles List
+	// MEGA user handles of node owners, only known for files inside folder links
+	Owners List
+	// maximum file size in bytes, 0 for unlimited
+	MaxSize int64 `mapstructure:"max_size"`
+	// client IPs or CIDR ranges
+	Clients List
+	// hotlink protection
+	Referer RefererList
+}
+
+type compiled struct {
+	Rules
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+func compile(r Rules) (*compiled, error) {
+	c := &compiled{Rules: r}
+	var err error
+	if c.allowNets, err = netutil.ParseNets(r.Clients.Allow); err != nil {
+		return nil, errorx.Decorate(err, "invalid clients.allow")
+	}
+	if c.denyNets, err = netutil.ParseNets(r.Clients.Deny); err != nil {
+		return nil, errorx.Decorate(err, "invalid clients.deny")
+	}
+	if r.MaxSize < 0 {
+		return nil, errors.New("max_size must not be negative")
+	}
+	return c, nil
+}
+
+// Engine evaluates the current rules, rules can be swapped at any time
+type Engine struct {
+	rules atomic.Value // *compiled
+
+	mu   sync.Mutex // serializes reads of the policy file
+	read func() (*compiled, error)
+}
+
+func New(r Rules) (*Engine, error) {
+	c, err := compile(r)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{}
+	e.rules.Store(c)
+	return e, nil
+}
+
+// Load reads rules from a yaml, toml or json file and reloads them whenever the file changes,
+// a broken file is reported and the previous rules stay in effect
+func Load(file string) (*Engine, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	e := &Engine{}
+	e.read = func() (*compiled, error) {
+		if err := v.ReadInConfig(); err != nil {
+			return nil, errorx.Decorate(err, "read policy file failed")
+		}
+		var r Rules
+		if err := v.UnmarshalExact(&r); err != nil {
+			return nil, errorx.Decorate(err, "decode policy file failed")
+		}
+		return compile(r)
+	}
+
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	v.OnConfigChange(func(fsnotify.Event) {
+		if err := e.Reload(); err != nil {
+			logrus.WithError(err).Warn("policy reload failed, keep previous rules")
+		} else {
+			logrus.WithField("file", file).Info("policy reloaded")
+		}
+	})
+	v.WatchConfig()
+	return e, nil
+}
+
+// Reload reads the policy file again, a broken file keeps the previous rules in effect.
+// Rules of an engine made by New are left alone.
+func (e *Engine) Reload() error {
+	if e.read == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, err := e.read()
+	if err != nil {
+		return err
+	}
+	e.rules.Store(c)
+	return nil
+}
+
+func (e *Engine) current() *compiled {
+	return e.rules.Load().(*compiled)
+}
+
+func denied(format string, args ...interface{}) error {
+	return errorx.Decorate(ErrDenied, format, args...)
+}
+
+func matchList(l List, v string) (allowed bool) {
+	for _, d := range l.Deny {
+		if d == v {
+			return false
+		}
+	}
+	if len(l.Allow) == 0 {
+		return true
+	}
+	for _, a := range l.Allow {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if p == host || strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckClient is evaluated before any MEGA api request
+func (e *Engine) CheckClient(ip, referer string) error {
+	r := e.current()
+
+	addr := net.ParseIP(ip)
+	if len(r.denyNets) != 0 || len(r.allowNets) != 0 {
+		if addr == nil || netutil.Contains(r.denyNets, addr) {
+			return denied("client %s", ip)
+		}
+		if len(r.allowNets) != 0 && !netutil.Contains(r.allowNets, addr) {
+			return denied("client %s", ip)
+		}
+	}
+
+	if referer == "" {
+		if len(r.Referer.Allow) != 0 && !r.Referer.AllowEmpty {
+			return denied("empty referer")
+		}
+		return nil
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return denied("invalid referer")
+	}
+	host := u.Hostname()
+	if matchHost(r.Referer.Deny, host) || len(r.Referer.Allow) != 0 && !matchHost(r.Referer.Allow, host) {
+		return denied("referer %s", host)
+	}
+	return nil
+}
+
+// CheckHandles checks node handles, it is evaluated before any MEGA api request
+func (e *Engine) CheckHandles(handles ...string) error {
+	if len(handles) == 0 {
+		return nil
+	}
+	r := e.current()
+	for _, h := range handles {
+		if !matchList(List{Deny: r.Handles.Deny}, h) {
+			return denied("handle %s", h)
+		}
+	}
+	if len(r.Handles.Allow) == 0 {
+		return nil
+	}
+	for _, h := range handles {
+		if matchList(List{Allow: r.Handles.Allow}, h) {
+			return nil
+		}
+	}
+	return denied("handles %v not allowed", handles)
+}
+
+// CheckNode checks the node metadata, owner is empty if unknown
+func (e *Engine) CheckNode(owner string, size int64) error {
+	r := e.current()
+	if (owner != "" || len(r.Owners.Allow) != 0) && !matchList(r.Owners, owner) {
+		return denied("owner %q", owner)
+	}
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return denied("size %d exceeds %d", size, r.MaxSize)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"github.com/mocukie/megalink/pkg/errutil"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEngine(t *testing.T) {
+	e, err := New(Rules{
+		Handles: List{Deny: []string{"badbadba"}},
+		Owners:  List{Allow: []string{"owner001"}},
+		MaxSize: 1 << 30,
+		Clients: List{Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"10.6.6.6"}},
+		Referer: RefererList{Allow: []string{"*.example.com"}, AllowEmpty: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"client in range", e.CheckClient("10.1.2.3", ""), true},
+		{"ipv6 client", e.CheckClient("::1", ""), true},
+		{"client denied", e.CheckClient("10.6.6.6", ""), false},
+		{"client out of range", e.CheckClient("192.168.1.1", ""), false},
+		{"referer allowed", e.CheckClient("10.1.2.3", "https://www.example.com/page"), true},
+		{"referer hotlink", e.CheckClient("10.1.2.3", "https://evil.com/"), false},
+		{"handle allowed", e.CheckHandles("abcdefgh"), true},
+		{"folder handle denied", e.CheckHandles("badbadba", "abcdefgh"), false},
+		{"owner allowed", e.CheckNode("owner001", 100), true},
+		{"owner unknown", e.CheckNode("", 100), false},
+		{"too large", e.CheckNode("owner001", 2<<30), false},
+	} {
+		if (c.err == nil) != c.want {
+			t.Errorf("%s: got %v", c.name, c.err)
+		} else if c.err != nil && errutil.Cause(c.err) != ErrDenied {
+			t.Errorf("%s: unexpected error %v", c.name, c.err)
+		}
+	}
+
+	if _, err = New(Rules{Clients: List{Allow: []string{"not-an-ip"}}}); err == nil {
+		t.Error("expect invalid client range error")
+	}
+}
+
+func TestLoadReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(file, []byte("max_size: 100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.CheckNode("", 200); err == nil {
+		t.Fatal("expect size denial")
+	}
+
+	if err = ioutil.WriteFile(file, []byte("max_size: 1000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && e.CheckNode("", 200) != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err = e.CheckNode("", 200); err != nil {
+		t.Errorf("rules not reloaded: %v", err)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("max_size: -1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Reload(); err == nil {
+		t.Error("expect reload error of a broken file")
+	}
+	if err = e.CheckNode("", 200); err != nil {
+		t.Errorf("previous rules lost: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the first socket passed by socket activation, after stdin, stdout and stderr
+const listenFdsStart = 3
+
+// Notify sends state to the service manager, e.g. "READY=1" or "STATUS=...", see sd_notify(3).
+// It returns false without error when not run by systemd with Type=notify.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	// names starting with @ are abstract sockets, which net handles by itself
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the WatchdogSec= of the service, 0 when the watchdog is off
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog sends WATCHDOG=1 twice per interval until ctx is done
+func Watchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = Notify("WATCHDOG=1")
+		}
+	}
+}
+
+var (
+	filesOnce sync.Once
+	files     []*os.File
+)
+
+// listenFds returns the descriptors and names of LISTEN_FDS and LISTEN_FDNAMES, none when
+// they are meant for another process
+func listenFds(pid, fds, fdNames string) ([]int, []string) {
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	given := strings.Split(fdNames, ":")
+	list, names := make([]int, n), make([]string, n)
+	for i := range list {
+		list[i] = listenFdsStart + i
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		} else {
+			names[i] = "LISTEN_FD_" + strconv.Itoa(list[i])
+		}
+	}
+	return list, names
+}
+
+// Files returns the sockets passed by socket activation, named after their FileDescriptorName=.
+// The environment variables are cleared, so that child processes don't take them for theirs.
+func Files() []*os.File {
+	filesOnce.Do(func() {
+		fds, names := listenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+		for i, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), names[i]))
+		}
+		for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(env)
+		}
+	})
+	return files
+}
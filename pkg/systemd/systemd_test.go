@@ -0,0 +1,79 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Fatalf("without NOTIFY_SOCKET: sent %v, err %v", sent, err)
+	}
+
+	name := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unsupported: %v", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if sent, err := Notify("READY=1\nSTATUS=serving"); !sent || err != nil {
+		t.Fatalf("sent %v, err %v", sent, err)
+	}
+	buf := make([]byte, 256)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1\nSTATUS=serving" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if d := WatchdogInterval(); d != 30*time.Second {
+		t.Errorf("got %v", d)
+	}
+	os.Setenv("WATCHDOG_PID", "0")
+	if d := WatchdogInterval(); d != 0 {
+		t.Errorf("watchdog of another process: got %v", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("WATCHDOG_USEC", "off")
+	if d := WatchdogInterval(); d != 0 {
+		t.Errorf("invalid WATCHDOG_USEC: got %v", d)
+	}
+}
+
+func TestListenFds(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for i, tc := range []struct {
+		pid, fds, names string
+		wantFds         []int
+		wantNames       []string
+	}{
+		{pid, "2", "http:", []int{3, 4}, []string{"http", "LISTEN_FD_4"}},
+		{pid, "1", "", []int{3}, []string{"LISTEN_FD_3"}},
+		{"0", "2", "", nil, nil},
+		{pid, "0", "", nil, nil},
+		{pid, "", "", nil, nil},
+	} {
+		fds, names := listenFds(tc.pid, tc.fds, tc.names)
+		if !reflect.DeepEqual(fds, tc.wantFds) || !reflect.DeepEqual(names, tc.wantNames) {
+			t.Errorf("#%d: got %v %v, want %v %v", i, fds, names, tc.wantFds, tc.wantNames)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"os"
+	"sort"
+	"sync"
+)
+
+type Config struct {
+	// name of a registered exporter, stdout and otlp are built in, empty disables tracing
+	Exporter string
+	// OTLP/HTTP collector host:port, default the OTEL_EXPORTER_OTLP_* environment or localhost:4318
+	Endpoint string
+	// plain HTTP to the collector
+	Insecure bool
+	// fraction of new traces that are sampled, the decision of a propagated parent is kept
+	SampleRatio float64
+	ServiceName string
+	Version     string
+}
+
+// ExporterFactory creates the span exporter of a Config
+type ExporterFactory func(ctx context.Context, conf Config) (sdktrace.SpanExporter, error)
+
+var (
+	mu        sync.Mutex
+	exporters = map[string]ExporterFactory{
+		"stdout": func(context.Context, Config) (sdktrace.SpanExporter, error) {
+			return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+		},
+		"otlp": func(ctx context.Context, conf Config) (sdktrace.SpanExporter, error) {
+			var opts []otlptracehttp.Option
+			if conf.Endpoint != "" {
+				opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+			}
+			if conf.Insecure {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			return otlptracehttp.New(ctx, opts...)
+		},
+	}
+)
+
+// RegisterExporter makes an exporter available to Setup by name, it replaces an exporter of the same name
+func RegisterExporter(name string, f ExporterFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	exporters[name] = f
+}
+
+func exporterNames() []string {
+	names := make([]string, 0, len(exporters))
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Setup installs the global tracer provider and the W3C trace context propagator,
+// shutdown flushes the spans still buffered
+func Setup(ctx context.Context, conf Config) (shutdown func(context.Context) error, err error) {
+	if conf.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	mu.Lock()
+	factory, ok := exporters[conf.Exporter]
+	names := exporterNames()
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown trace exporter %q, available: %v", conf.Exporter, names)
+	}
+	exp, err := factory(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ServiceName == "" {
+		conf.ServiceName = "megalink"
+	}
+	if conf.SampleRatio <= 0 || conf.SampleRatio > 1 {
+		conf.SampleRatio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(conf.ServiceName),
+			semconv.ServiceVersionKey.String(conf.Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
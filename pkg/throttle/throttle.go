@@ -0,0 +1,306 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SourceDefault  = "default"
+	SourceSchedule = "schedule"
+	SourceOverride = "override"
+
+	// the schedule is evaluated at most this often
+	checkInterval = time.Second
+	// smallest burst, so that a small rate still lets a read buffer through in a few waits
+	minBurst = 16 << 10
+)
+
+// Limits are in bytes per second, 0 means unlimited
+type Limits struct {
+	// shared by all transfers
+	Global int64 `json:"global"`
+	// of every single transfer
+	PerConn int64 `json:"per_conn" mapstructure:"per_conn"`
+}
+
+// Window applies its limits between From and To (minutes of the day) on the given days,
+// a window with To before From runs past midnight
+type Window struct {
+	Days   []time.Weekday // empty for every day
+	From   int
+	To     int
+	Limits Limits
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseWindow parses "[days ]HH:MM-HH:MM global[/per_conn]", days is a weekday or a range
+// like mon-fri, sizes accept K, M and G suffixes, e.g. "mon-fri 09:00-18:00 2M/512K"
+func ParseWindow(s string) (w Window, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 3 {
+		if w.Days, err = parseDays(fields[0]); err != nil {
+			return
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return w, fmt.Errorf("invalid schedule %q", s)
+	}
+
+	span := strings.SplitN(fields[0], "-", 2)
+	if len(span) != 2 {
+		return w, fmt.Errorf("invalid schedule time %q", fields[0])
+	}
+	if w.From, err = parseClock(span[0]); err != nil {
+		return
+	}
+	if w.To, err = parseClock(span[1]); err != nil {
+		return
+	}
+
+	rates := strings.SplitN(fields[1], "/", 2)
+	if w.Limits.Global, err = ParseRate(rates[0]); err != nil {
+		return
+	}
+	if len(rates) == 2 {
+		w.Limits.PerConn, err = ParseRate(rates[1])
+	}
+	return
+}
+
+func parseDays(s string) ([]time.Weekday, error) {
+	day := func(name string) (time.Weekday, error) {
+		for i, d := range weekdays {
+			if strings.EqualFold(name, d) {
+				return time.Weekday(i), nil
+			}
+		}
+		return 0, fmt.Errorf("invalid weekday %q", name)
+	}
+
+	span := strings.SplitN(s, "-", 2)
+	first, err := day(span[0])
+	if err != nil {
+		return nil, err
+	}
+	last := first
+	if len(span) == 2 {
+		if last, err = day(span[1]); err != nil {
+			return nil, err
+		}
+	}
+	days := []time.Weekday{first}
+	for d := first; d != last; {
+		d = (d + 1) % 7
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseRate parses a byte rate with an optional K, M or G (1024 based) suffix
+func ParseRate(s string) (int64, error) {
+	mul, num := int64(1), s
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mul = 1 << 10
+		case 'm', 'M':
+			mul = 1 << 20
+		case 'g', 'G':
+			mul = 1 << 30
+		}
+		if mul != 1 {
+			num = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n * mul, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (w Window) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, day := range w.Days {
+		if day == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) active(now time.Time) bool {
+	m := now.Hour()*60 + now.Minute()
+	if w.From <= w.To {
+		return m >= w.From && m < w.To && w.onDay(now.Weekday())
+	}
+	// past midnight the window belongs to the day it started on
+	if m >= w.From {
+		return w.onDay(now.Weekday())
+	}
+	return m < w.To && w.onDay((now.Weekday()+6)%7)
+}
+
+// Throttle holds the current limits, the first active schedule window replaces the
+// default limits and an override set at runtime replaces both until it is cleared
+type Throttle struct {
+	gen    uint64 // bumped whenever the limits change, first for 64-bit alignment
+	global *rate.Limiter
+
+	mu       sync.Mutex
+	base     Limits
+	schedule []Window
+	override *Limits
+	current  Limits
+	source   string
+	checked  time.Time
+}
+
+func New(base Limits, schedule []Window) *Throttle {
+	t := &Throttle{
+		global:   rate.NewLimiter(rate.Inf, minBurst),
+		base:     base,
+		schedule: schedule,
+	}
+	t.refresh(time.Now(), true)
+	return t
+}
+
+func setRate(l *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(bps))
+	l.SetBurst(burst(bps))
+}
+
+func burst(bps int64) int {
+	if bps < minBurst {
+		return minBurst
+	}
+	if bps > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(bps)
+}
+
+func (t *Throttle) refresh(now time.Time, force bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !force && now.Sub(t.checked) < checkInterval {
+		return
+	}
+	t.checked = now
+
+	limits, source := t.base, SourceDefault
+	if t.override != nil {
+		limits, source = *t.override, SourceOverride
+	} else {
+		for _, w := range t.schedule {
+			if w.active(now) {
+				limits, source = w.Limits, SourceSchedule
+				break
+			}
+		}
+	}
+	if limits == t.current && source == t.source && !force {
+		return
+	}
+	t.current, t.source = limits, source
+	setRate(t.global, limits.Global)
+	atomic.AddUint64(&t.gen, 1)
+}
+
+// Limits returns the limits in effect and where they come from
+func (t *Throttle) Limits() (Limits, string) {
+	t.refresh(time.Now(), false)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current, t.source
+}
+
+// SetDefaults replaces the default limits and the schedule, downloads in flight follow at once
+func (t *Throttle) SetDefaults(base Limits, schedule []Window) {
+	t.mu.Lock()
+	t.base, t.schedule = base, schedule
+	t.mu.Unlock()
+	t.refresh(time.Now(), true)
+}
+
+// Override replaces the default and scheduled limits, nil goes back to them
+func (t *Throttle) Override(l *Limits) {
+	t.mu.Lock()
+	if l != nil {
+		cp := *l
+		l = &cp
+	}
+	t.override = l
+	t.mu.Unlock()
+	t.refresh(time.Now(), true)
+}
+
+// Conn is the limiter of a single transfer, it stops waiting once ctx is done
+type Conn struct {
+	t   *Throttle
+	ctx context.Context
+	own *rate.Limiter
+	gen uint64
+}
+
+func (t *Throttle) Conn(ctx context.Context) *Conn {
+	return &Conn{t: t, ctx: ctx, own: rate.NewLimiter(rate.Inf, minBurst)}
+}
+
+func (c *Conn) Wait(n int) error {
+	c.t.refresh(time.Now(), false)
+	if gen := atomic.LoadUint64(&c.t.gen); gen != c.gen {
+		c.t.mu.Lock()
+		perConn := c.t.current.PerConn
+		c.t.mu.Unlock()
+		setRate(c.own, perConn)
+		c.gen = gen
+	}
+
+	for _, l := range []*rate.Limiter{c.own, c.t.global} {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		// WaitN refuses more than the burst at once
+		for left := n; left > 0; {
+			chunk := min(left, l.Burst())
+			if err := l.WaitN(c.ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
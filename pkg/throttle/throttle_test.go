@@ -0,0 +1,88 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow("fri-mon 22:00-07:30 2M/512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.From != 22*60 || w.To != 7*60+30 || w.Limits != (Limits{Global: 2 << 20, PerConn: 512 << 10}) {
+		t.Errorf("got %+v", w)
+	}
+	if len(w.Days) != 4 || w.Days[0] != time.Friday || w.Days[3] != time.Monday {
+		t.Errorf("days %v", w.Days)
+	}
+
+	at := func(s string) time.Time {
+		v, _ := time.Parse("Mon 15:04 2006-01-02", s)
+		return v
+	}
+	for _, tc := range []struct {
+		now    string
+		active bool
+	}{
+		{"Fri 23:00 2021-04-02", true},
+		{"Sat 03:00 2021-04-03", true},
+		{"Tue 03:00 2021-04-06", true}, // started on monday night
+		{"Tue 23:00 2021-04-06", false},
+		{"Wed 03:00 2021-04-07", false},
+		{"Fri 12:00 2021-04-02", false},
+	} {
+		if got := w.active(at(tc.now)); got != tc.active {
+			t.Errorf("%s: active %v, want %v", tc.now, got, tc.active)
+		}
+	}
+
+	for _, s := range []string{"09:00-18:00", "someday 09:00-18:00 1M", "09:00 1M", "09:00-18:00 1X", "09:00-18:00 -1"} {
+		if _, err = ParseWindow(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	always := Window{From: 0, To: 24 * 60, Limits: Limits{Global: 1 << 20}}
+	th := New(Limits{PerConn: 64 << 10}, []Window{always})
+	if l, source := th.Limits(); source != SourceSchedule || l != always.Limits {
+		t.Errorf("scheduled: got %+v %s", l, source)
+	}
+
+	th.Override(&Limits{PerConn: 32 << 10})
+	if l, source := th.Limits(); source != SourceOverride || l.PerConn != 32<<10 {
+		t.Errorf("override: got %+v %s", l, source)
+	}
+
+	// the burst passes at once, the rest takes rate time
+	c := th.Conn(context.Background())
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.Wait(16 << 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("48K at 32K/s with 32K burst took %v", d)
+	}
+
+	th.Override(nil)
+	if _, source := th.Limits(); source != SourceSchedule {
+		t.Errorf("cleared override: source %s", source)
+	}
+
+	th.SetDefaults(Limits{Global: 2 << 20}, nil)
+	if l, source := th.Limits(); source != SourceDefault || l.Global != 2<<20 {
+		t.Errorf("new defaults: got %+v %s", l, source)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	th.Override(&Limits{Global: 1})
+	if err := th.Conn(ctx).Wait(1 << 20); err == nil {
+		t.Error("wait with cancelled context succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// files are checked for renewal at most this often, on the handshakes which happen meanwhile
+const checkInterval = 10 * time.Second
+
+// KeyPair serves a certificate and key file pair through GetCertificate, and reloads them
+// once either file changes, so that renewed certificates are used without a restart
+type KeyPair struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	p := &KeyPair{}
+	if err := p.SetFiles(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func modTimes(certFile, keyFile string) (t [2]time.Time, err error) {
+	for i, file := range []string{certFile, keyFile} {
+		st, err := os.Stat(file)
+		if err != nil {
+			return t, err
+		}
+		t[i] = st.ModTime()
+	}
+	return t, nil
+}
+
+// load must be called with p.mu held
+func (p *KeyPair) load(certFile, keyFile string) error {
+	mt, err := modTimes(certFile, keyFile)
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			p.certFile, p.keyFile, p.cert, p.modTimes = certFile, keyFile, &cert, mt
+			p.checked = time.Now()
+			return nil
+		}
+	}
+	return errorx.Decorate(err, "load certificate %s failed", certFile)
+}
+
+// SetFiles switches to another file pair, the current certificate stays on error
+func (p *KeyPair) SetFiles(certFile, keyFile string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.load(certFile, keyFile)
+}
+
+// Reload reads the files again, the current certificate stays on error
+func (p *KeyPair) Reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.load(p.certFile, p.keyFile)
+}
+
+// GetCertificate is a tls.Config.GetCertificate
+func (p *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now := time.Now(); now.Sub(p.checked) >= checkInterval {
+		p.checked = now
+		// a renewal may be half written, so a failed load is retried on the next check
+		if mt, err := modTimes(p.certFile, p.keyFile); err == nil && mt != p.modTimes {
+			if err = p.load(p.certFile, p.keyFile); err != nil {
+				logrus.WithError(err).Warn("certificate reload failed, keep previous certificate")
+			} else {
+				logrus.WithField("file", p.certFile).Info("certificate reloaded")
+			}
+		}
+	}
+	return p.cert, nil
+}
@@ -0,0 +1,98 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeyPair(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func commonName(t *testing.T, p *KeyPair) string {
+	cert, err := p.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "first")
+	p, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := commonName(t, p); cn != "first" {
+		t.Fatalf("got %q", cn)
+	}
+
+	// a renewal is picked up on the next check
+	writeKeyPair(t, dir, "renewed")
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	p.checked = time.Time{}
+	if cn := commonName(t, p); cn != "renewed" {
+		t.Errorf("renewal: got %q", cn)
+	}
+
+	// a broken file keeps the current certificate
+	if err = ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Reload(); err == nil {
+		t.Error("expect reload error")
+	}
+	if cn := commonName(t, p); cn != "renewed" {
+		t.Errorf("after failed reload: got %q", cn)
+	}
+
+	other := t.TempDir()
+	certFile, keyFile = writeKeyPair(t, other, "other")
+	if err = p.SetFiles(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if cn := commonName(t, p); cn != "other" {
+		t.Errorf("switched files: got %q", cn)
+	}
+}
@@ -0,0 +1,213 @@
+package tlsutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	caFile        = "ca.pem"
+	caKeyFile     = "ca-key.pem"
+	serverFile    = "cert.pem"
+	serverKeyFile = "key.pem"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+	// the server certificate is issued again when it expires sooner
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// SelfSigned returns the certificate and key files of a server certificate for hosts, host names
+// or IP addresses, in dir. It is signed by a CA created in dir on first use, whose ca.pem clients
+// can trust. The certificate is issued again when hosts change or it is about to expire.
+func SelfSigned(dir string, hosts []string) (certFile, keyFile string, err error) {
+	if len(hosts) == 0 {
+		return "", "", errors.New("no host names for the self-signed certificate")
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", "", errorx.Decorate(err, "create %s failed", dir)
+	}
+	ca, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile, keyFile = filepath.Join(dir, serverFile), filepath.Join(dir, serverKeyFile)
+	if cert, err := readCert(certFile); err == nil && fresh(cert, ca, hosts) {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", errorx.Decorate(err, "generate server key failed")
+	}
+	tmpl, err := template(hosts[0], serverValidity)
+	if err != nil {
+		return "", "", err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", errorx.Decorate(err, "issue server certificate failed")
+	}
+	if err = writePair(certFile, keyFile, der, key); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certFile, keyFile := filepath.Join(dir, caFile), filepath.Join(dir, caKeyFile)
+	cert, err := readCert(certFile)
+	if err == nil {
+		key, err := readKey(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errorx.Decorate(err, "generate CA key failed")
+	}
+	tmpl, err := template("megalink CA", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.MaxPathLenZero = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errorx.Decorate(err, "create CA certificate failed")
+	}
+	if err = writePair(certFile, keyFile, der, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func template(cn string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errorx.Decorate(err, "generate serial number failed")
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"megalink"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// fresh tells whether cert is signed by ca, valid for a while and for exactly hosts
+func fresh(cert, ca *x509.Certificate, hosts []string) bool {
+	if cert.CheckSignatureFrom(ca) != nil || time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+	have := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		have = append(have, ip.String())
+	}
+	want := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			h = ip.String()
+		}
+		want = append(want, h)
+	}
+	sort.Strings(have)
+	sort.Strings(want)
+	return fmt.Sprint(have) == fmt.Sprint(want)
+}
+
+func readCert(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errorx.Decorate(err, "read %s failed", file)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errorx.Decorate(err, "parse %s failed", file)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key in %s", file)
+	}
+	return signer, nil
+}
+
+func writePair(certFile, keyFile string, der []byte, key crypto.Signer) error {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errorx.Decorate(err, "encode key failed")
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return errorx.Decorate(err, "write %s failed", keyFile)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return errorx.Decorate(err, "write %s failed", certFile)
+	}
+	return nil
+}
+
+// LoadCertPool reads PEM encoded CA certificates, e.g. those client certificates must be signed by
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errorx.Decorate(err, "read %s failed", file)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,61 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfSigned(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	hosts := []string{"megalink.test", "127.0.0.1"}
+	certFile, keyFile, err := SelfSigned(dir, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := LoadCertPool(filepath.Join(dir, caFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hosts {
+		if _, err = leaf.Verify(x509.VerifyOptions{DNSName: h, Roots: pool}); err != nil {
+			t.Errorf("verify %s: %v", h, err)
+		}
+	}
+
+	// kept while hosts stay the same
+	before, _ := ioutil.ReadFile(certFile)
+	if _, _, err = SelfSigned(dir, []string{"127.0.0.1", "megalink.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(certFile); string(after) != string(before) {
+		t.Error("certificate issued again for the same hosts")
+	}
+
+	// issued again by the same CA for new hosts
+	caBefore, _ := ioutil.ReadFile(filepath.Join(dir, caFile))
+	if _, _, err = SelfSigned(dir, []string{"other.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(certFile); string(after) == string(before) {
+		t.Error("certificate not issued again for new hosts")
+	}
+	if caAfter, _ := ioutil.ReadFile(filepath.Join(dir, caFile)); string(caAfter) != string(caBefore) {
+		t.Error("CA replaced")
+	}
+
+	if _, _, err = SelfSigned(dir, nil); err == nil {
+		t.Error("expect error without hosts")
+	}
+}
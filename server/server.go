@@ -0,0 +1,210 @@
+// Package server builds the megalink HTTP handler, so that megalink can be mounted in other Go services
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/policy"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/accesslog"
+	"github.com/mocukie/megalink/web/api"
+	"github.com/mocukie/megalink/web/auth"
+	"github.com/mocukie/megalink/web/dl"
+	"github.com/mocukie/megalink/web/drain"
+	"github.com/mocukie/megalink/web/health"
+	"github.com/mocukie/megalink/web/metrics"
+	"github.com/mocukie/megalink/web/quota"
+	"github.com/mocukie/megalink/web/ratelimit"
+	"github.com/mocukie/megalink/web/static"
+	"github.com/mocukie/megalink/web/tracing"
+	"github.com/sirupsen/logrus"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options of New, the zero value serves /dl links, the web UI, /api and health probes without limits or auth
+type Options struct {
+	// MEGA client of the lookups and downloads, default a new one over http.DefaultClient
+	Client *mega.Client
+	// access and error log, default the standard logrus logger
+	Logger *logrus.Logger
+	// path prefix of all routes, e.g. /megalink
+	BasePath string
+	// reverse proxies whose X-Forwarded-* headers are honored
+	TrustedProxies []*net.IPNet
+	// peers on Unix sockets are trusted proxies too
+	TrustUnixPeers bool
+	// web UI files, default the embedded www directory
+	WWW fs.FS
+
+	// authentication of every route, Auth.Authenticate lets the embedding service vouch for its users
+	Auth auth.Config
+	// users allowed on /api/admin
+	Admins []string
+	// loopback clients are admins too, e.g. curl on the same host
+	LocalAdmins bool
+
+	// fetch upstream with several concurrent connections when Segment.Conns > 1
+	Segment mega.Segmented
+	// serve /s/:token links and /api/sign when not nil
+	Signer *linksign.Signer
+	// expiry of signed links that don't ask for one, 0 means never
+	SignTTL time.Duration
+	// disable /dl/:link so that keys never appear in URLs
+	SignedOnly bool
+	// serve /a/:alias and /api/aliases when not nil
+	Aliases *alias.Store
+	// API keys with quotas and scopes, /api/admin/keys is served when not nil
+	Keys *apikey.Store
+	// access policy checked before links are resolved, nil allows everything
+	Policy *policy.Engine
+
+	// per client lookup and stream limits, nil for unlimited
+	Limiter *ratelimit.Limiter
+	// bandwidth limits, /api/admin/throttle is served when not nil
+	Throttle *throttle.Throttle
+	// tracks downloads, so that they can be waited for on shutdown
+	Transfers *drain.Tracker
+
+	// request and download metrics, also of the MEGA api calls of Client
+	Metrics *metrics.Metrics
+	// served at /metrics without auth when not nil, e.g. Metrics.Handler
+	MetricsHandler http.Handler
+	// trace requests, telemetry.Setup must have been called
+	Tracing bool
+	// how long the MEGA api check of /readyz is reused, default health.DefaultTTL
+	ReadyTTL time.Duration
+}
+
+// New returns the handler serving megalink, its routes are below opts.BasePath
+func New(opts Options) (http.Handler, error) {
+	if opts.Client == nil {
+		opts.Client = mega.NewClient(http.DefaultClient)
+	}
+	if opts.WWW == nil {
+		f, err := fs.Sub(megalink.WWW, "www")
+		if err != nil {
+			return nil, err
+		}
+		opts.WWW = f
+	}
+
+	// gin.Logger would write MEGA keys in request paths, accesslog redacts them
+	engine := gin.New()
+	// client addresses are resolved by web.RealIP from trusted proxies only
+	engine.ForwardedByClientIP = false
+	logMiddleware := accesslog.Middleware
+	if opts.Logger != nil {
+		logMiddleware = accesslog.WithLogger(opts.Logger)
+	}
+	engine.Use(logMiddleware, windowsBrokenPipeRecovery(), web.RealIP(opts.TrustedProxies, opts.TrustUnixPeers), func(c *gin.Context) {
+		c.Header("Server", "nginx/1.14.514")
+		c.Next()
+	})
+	if opts.Tracing {
+		engine.Use(tracing.Middleware)
+	}
+	if opts.Metrics != nil {
+		opts.Client.SetAPIHook(opts.Metrics.ObserveAPICall)
+		engine.Use(opts.Metrics.Middleware)
+	}
+	// set up before the routers, so that scrapers and probes don't need user credentials
+	if opts.MetricsHandler != nil {
+		engine.GET("/metrics", gin.WrapH(opts.MetricsHandler))
+	}
+	health.NewRouter(health.Options{Client: opts.Client, TTL: opts.ReadyTTL}).Setup(engine)
+
+	var lookup, transfer []gin.HandlerFunc
+	// outermost, so that every download is waited for on shutdown
+	if opts.Transfers != nil {
+		transfer = append(transfer, opts.Transfers.Transfer)
+	}
+	if opts.Limiter != nil {
+		lookup = append(lookup, opts.Limiter.Lookup)
+		transfer = append(transfer, opts.Limiter.Stream)
+	}
+	if opts.Keys != nil {
+		transfer = append(transfer, quota.Transfer(opts.Keys))
+	}
+	// innermost, so that only downloads which got through the limits are counted
+	if opts.Metrics != nil {
+		transfer = append(transfer, opts.Metrics.Transfer)
+	}
+	transfer = append(transfer, accesslog.Transfer)
+
+	var routers []web.IRouter
+	if opts.Auth.Keys == nil {
+		opts.Auth.Keys = opts.Keys
+	}
+	if opts.Auth.Enabled() {
+		// must come first, only routers set up after it are protected
+		authRouter, err := auth.NewRouter(opts.Auth)
+		if err != nil {
+			return nil, err
+		}
+		routers = append(routers, authRouter)
+	}
+	routers = append(routers,
+		api.NewRouter(api.Options{
+			Signer:      opts.Signer,
+			SignTTL:     opts.SignTTL,
+			Aliases:     opts.Aliases,
+			Lookup:      lookup,
+			Admins:      opts.Admins,
+			LocalAdmins: opts.LocalAdmins,
+			Throttle:    opts.Throttle,
+			Keys:        opts.Keys,
+		}),
+		dl.NewRouter(dl.Options{
+			Client:     opts.Client,
+			Segment:    opts.Segment,
+			Signer:     opts.Signer,
+			SignedOnly: opts.SignedOnly,
+			Aliases:    opts.Aliases,
+			Policy:     opts.Policy,
+			Lookup:     lookup,
+			Transfer:   transfer,
+			Throttle:   opts.Throttle,
+			Keys:       opts.Keys,
+		}),
+		static.NewRouter("/", http.FS(opts.WWW)),
+	)
+	for _, r := range routers {
+		r.Setup(engine)
+	}
+	return web.StripBasePath(opts.BasePath, engine), nil
+}
+
+func windowsBrokenPipeRecovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				var brokenPipe bool
+				if ne, ok := err.(*net.OpError); ok {
+					if se, ok := ne.Err.(*os.SyscallError); ok {
+						if strings.Contains(strings.ToLower(se.Error()), "an established connection was aborted by the software in your host machine") ||
+							strings.Contains(strings.ToLower(se.Error()), "an existing connection was forcibly closed by the remote host") {
+							brokenPipe = true
+						}
+					}
+				}
+				if brokenPipe {
+					c.Error(err.(error))
+					c.Abort()
+				} else {
+					panic(err) //rethrow
+				}
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"github.com/mocukie/megalink/web/auth"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var upstream int32
+	client := mega.NewClient(&http.Client{Transport: megatest.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&upstream, 1)
+		return nil, errors.New("offline")
+	})})
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	h, err := New(Options{
+		Client:   client,
+		Logger:   logger,
+		BasePath: "/megalink",
+		Auth: auth.Config{
+			Authenticate: func(req *http.Request) (string, bool) {
+				return req.Header.Get("X-User"), req.Header.Get("X-User") != ""
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	link := "/megalink/dl/abcdefgh!abcdefghijklmnopqrstuvwxyzabcdefghijklmnopq"
+	if w := do(link, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without user: got %d", w.Code)
+	}
+	if atomic.LoadInt32(&upstream) != 0 {
+		t.Error("unauthenticated request reached MEGA")
+	}
+	if w := do(link, "bob"); w.Code == http.StatusUnauthorized || atomic.LoadInt32(&upstream) == 0 {
+		t.Errorf("with user: got %d, %d upstream requests", w.Code, upstream)
+	}
+	if !strings.Contains(out.String(), "user=bob") {
+		t.Errorf("access line not written to the logger: %q", out.String())
+	}
+
+	if w := do("/megalink/", "bob"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "MEGA Link") {
+		t.Errorf("index page: got %d", w.Code)
+	}
+	if w := do("/megalink/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("healthz needs no user: got %d", w.Code)
+	}
+	if w := do("/dl/x", "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("route outside the base path: got %d", w.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package accesslog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/logging"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/auth"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestIDKey    = "request.id"
+	loggerKey       = "request.logger"
+	requestIDHeader = "X-Request-ID"
+)
+
+// ids passed in by a proxy are kept when they look sane
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID returns the id of the request, empty without Middleware
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Logger returns the logger of the request, the standard logger without WithLogger
+func Logger(c *gin.Context) *logrus.Logger {
+	if l, ok := c.Get(loggerKey); ok {
+		return l.(*logrus.Logger)
+	}
+	return logrus.StandardLogger()
+}
+
+// Entry returns a log entry of the request, with its id and trace id
+func Entry(c *gin.Context) *logrus.Entry {
+	e := Logger(c).WithField("request_id", RequestID(c))
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.HasTraceID() {
+		e = e.WithField("trace_id", sc.TraceID().String())
+	}
+	return e
+}
+
+// WithLogger is Middleware writing to l instead of the standard logger
+func WithLogger(l *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(loggerKey, l)
+		Middleware(c)
+	}
+}
+
+// Middleware assigns request ids, recovers panics and writes an access line per request,
+// it must be used before any other middleware
+func Middleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !requestIDRegex.MatchString(id) {
+		id = newRequestID()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			Entry(c).WithFields(logrus.Fields{
+				"panic": logging.Redact(fmt.Sprint(p)),
+				"stack": string(debug.Stack()),
+			}).Error("panic recovered")
+			if !c.Writer.Written() {
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}
+		}
+		access(c, time.Since(start))
+	}()
+	c.Next()
+}
+
+func access(c *gin.Context, elapsed time.Duration) {
+	status := c.Writer.Status()
+	fields := logrus.Fields{
+		"method":   c.Request.Method,
+		"path":     logging.Redact(c.Request.URL.RequestURI()),
+		"status":   status,
+		"bytes":    size(c),
+		"duration": elapsed.Seconds(),
+		"client":   web.ClientIP(c),
+	}
+	if route := c.FullPath(); route != "" {
+		fields["route"] = route
+	}
+	if user := auth.User(c); user != "" {
+		fields["user"] = user
+	}
+	if ref := c.GetHeader("Referer"); ref != "" {
+		fields["referer"] = logging.Redact(ref)
+	}
+	if len(c.Errors) != 0 {
+		msgs := make([]string, len(c.Errors))
+		for i, e := range c.Errors {
+			msgs[i] = logging.Redact(e.Error())
+		}
+		fields["error"] = strings.Join(msgs, "; ")
+	}
+
+	entry := Entry(c).WithFields(fields)
+	if status >= http.StatusInternalServerError {
+		entry.Error("request")
+	} else {
+		entry.Info("request")
+	}
+
+	// errDetail formats errorx errors with their stack traces on %+v
+	if Logger(c).IsLevelEnabled(logrus.DebugLevel) {
+		for _, e := range c.Errors {
+			detail := e.Meta
+			if detail == nil {
+				detail = e.Err
+			}
+			Entry(c).WithField("stack", logging.Redact(fmt.Sprintf("%+v", detail))).Debug("request error")
+		}
+	}
+}
+
+func size(c *gin.Context) int {
+	if n := c.Writer.Size(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Transfer writes a summary line per download, it must wrap the download handler
+func Transfer(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	fields := logrus.Fields{
+		"bytes":    size(c),
+		"duration": time.Since(start).Seconds(),
+		"status":   c.Writer.Status(),
+	}
+	if info, ok := c.Get("info"); ok {
+		fields["handle"] = info.(*mega.NodeInfo).Handle
+	}
+	if rg := c.GetHeader("Range"); rg != "" {
+		fields["range"] = rg
+	}
+
+	outcome := "complete"
+	want, _ := strconv.Atoi(c.Writer.Header().Get("Content-Length"))
+	switch {
+	case c.Writer.Status() >= http.StatusBadRequest:
+		outcome = "error"
+	case c.Request.Context().Err() != nil:
+		outcome = "aborted"
+	case size(c) < want:
+		outcome = "incomplete"
+	}
+	fields["outcome"] = outcome
+	Entry(c).WithFields(fields).Info("transfer")
+}
@@ -0,0 +1,79 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	out, formatter := logrus.StandardLogger().Out, logrus.StandardLogger().Formatter
+	t.Cleanup(func() {
+		logrus.SetOutput(out)
+		logrus.SetFormatter(formatter)
+	})
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+
+	e := gin.New()
+	e.Use(Middleware)
+	e.GET("/dl/:link", func(c *gin.Context) {
+		c.String(200, "ok")
+	})
+	e.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+	e.GET("/storage", func(c *gin.Context) {
+		_ = c.Error(errorx.Decorate(&url.Error{
+			Op:  "Get",
+			URL: "https://gfs270n141.userstorage.mega.co.nz/dl/Xy-Z_1a2b3c/0-999",
+			Err: errors.New("connection reset by peer"),
+		}, "open download failed"))
+		c.AbortWithStatus(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/dl/abcdefgh!0123456789012345678901?token=t0ken", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if w.Header().Get("X-Request-ID") != "req-1" {
+		t.Errorf("request id not echoed: %v", w.Header())
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if line["path"] != "/dl/abcdefgh!REDACTED?token=REDACTED" || line["request_id"] != "req-1" ||
+		line["route"] != "/dl/:link" || line["status"] != 200.0 || line["bytes"] != 2.0 {
+		t.Errorf("access line: %v", line)
+	}
+
+	buf.Reset()
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != 500 || !bytes.Contains(buf.Bytes(), []byte("panic recovered")) {
+		t.Errorf("panic: got %d, log %s", w.Code, buf.String())
+	}
+
+	// the storage URL of an upstream error is a download token, stack traces included
+	level := logrus.GetLevel()
+	t.Cleanup(func() {
+		logrus.SetLevel(level)
+	})
+	logrus.SetLevel(logrus.DebugLevel)
+	buf.Reset()
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/storage", nil))
+	if bytes.Contains(buf.Bytes(), []byte("Xy-Z_1a2b3c")) || !bytes.Contains(buf.Bytes(), []byte("userstorage.mega.co.nz/REDACTED")) {
+		t.Errorf("storage error: log %s", buf.String())
+	}
+}
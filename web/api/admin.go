@@ -0,0 +1,142 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/auth"
+	"net"
+	"net/http"
+	"time"
+)
+
+// requireAdmin lets through the admins only
+func (r routerImpl) requireAdmin(c *gin.Context) {
+	if !r.isAdmin(c) {
+		abortWithJSON(c, http.StatusForbidden, "admin only")
+	}
+}
+
+// isAdmin tells whether the client is one of the configured admin users, or a local client when allowed
+func (r routerImpl) isAdmin(c *gin.Context) bool {
+	if r.opts.LocalAdmins {
+		if ip := net.ParseIP(web.ClientIP(c)); ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+	if user := auth.User(c); user != "" {
+		for _, a := range r.opts.Admins {
+			if a == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type throttleResp struct {
+	throttle.Limits
+	Source string `json:"source"`
+}
+
+func (r routerImpl) getThrottle(c *gin.Context) {
+	l, source := r.opts.Throttle.Limits()
+	c.JSON(http.StatusOK, throttleResp{Limits: l, Source: source})
+}
+
+// setThrottle overrides the default and scheduled limits until deleted
+func (r routerImpl) setThrottle(c *gin.Context) {
+	var req throttle.Limits
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Global < 0 || req.PerConn < 0 {
+		abortWithJSON(c, http.StatusBadRequest, "limits must not be negative")
+		return
+	}
+	r.opts.Throttle.Override(&req)
+	r.getThrottle(c)
+}
+
+func (r routerImpl) deleteThrottle(c *gin.Context) {
+	r.opts.Throttle.Override(nil)
+	r.getThrottle(c)
+}
+
+// keyResp is a key with its usage, without the secret hash
+type keyResp struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	apikey.Limits
+	Scopes  []string     `json:"scopes,omitempty"`
+	Certs   []string     `json:"certs,omitempty"`
+	Created time.Time    `json:"created"`
+	Usage   apikey.Usage `json:"usage"`
+	// only returned on creation
+	Secret string `json:"secret,omitempty"`
+}
+
+func newKeyResp(k apikey.Key, u apikey.Usage) keyResp {
+	return keyResp{ID: k.ID, Name: k.Name, Limits: k.Limits, Scopes: k.Scopes, Certs: k.Certs, Created: k.Created, Usage: u}
+}
+
+func (r routerImpl) listKeys(c *gin.Context) {
+	keys, err := r.opts.Keys.List()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	report := r.opts.Keys.Report()
+	list := make([]keyResp, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, newKeyResp(k, report[k.ID]))
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (r routerImpl) getKey(c *gin.Context) {
+	k, err := r.opts.Keys.Get(c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newKeyResp(k, r.opts.Keys.Report()[k.ID]))
+}
+
+type keyReq struct {
+	Name string `json:"name" binding:"required"`
+	apikey.Limits
+	Scopes []string `json:"scopes"`
+	Certs  []string `json:"certs"`
+}
+
+// createKey answers with the secret of the new key, it is not shown again
+func (r routerImpl) createKey(c *gin.Context) {
+	var req keyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Daily < 0 || req.Monthly < 0 || req.MaxStreams < 0 {
+		abortWithJSON(c, http.StatusBadRequest, "limits must not be negative")
+		return
+	}
+	k, secret, err := r.opts.Keys.Create(req.Name, req.Limits, req.Scopes, req.Certs)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	resp := newKeyResp(k, apikey.Usage{})
+	resp.Secret = secret
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (r routerImpl) deleteKey(c *gin.Context) {
+	if err := r.opts.Keys.Delete(c.Param("id")); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/megalink"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/auth"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	// issue signed links, /api/sign is not served when nil
+	Signer *linksign.Signer
+	// expiry of signed links that don't ask for one, 0 means never
+	SignTTL time.Duration
+	// serve /api/aliases CRUD when not nil
+	Aliases *alias.Store
+	// run before every api handler, e.g. rate limiting
+	Lookup []gin.HandlerFunc
+	// users allowed on /api/admin, nobody when empty
+	Admins []string
+	// loopback clients are admins too
+	LocalAdmins bool
+	// serve /api/admin/throttle when not nil
+	Throttle *throttle.Throttle
+	// serve /api/admin/keys when not nil, key clients can only sign links in their scopes
+	Keys *apikey.Store
+}
+
+type routerImpl struct {
+	opts Options
+}
+
+func NewRouter(opts Options) web.IRouter {
+	return routerImpl{opts: opts}
+}
+
+func (r routerImpl) Setup(g gin.IRouter) {
+	g.GET("/api/openapi.json", openAPI())
+	g = g.Group("/api", r.opts.Lookup...)
+	if r.opts.Signer != nil {
+		g.POST("/sign", r.sign)
+	}
+	if r.opts.Aliases != nil {
+		g.GET("/aliases", r.listAliases)
+		g.GET("/aliases/:name", r.getAlias)
+		g.PUT("/aliases/:name", r.requireAdmin, r.setAlias)
+		g.DELETE("/aliases/:name", r.requireAdmin, r.deleteAlias)
+	}
+
+	admin := g.Group("/admin", r.requireAdmin)
+	if r.opts.Throttle != nil {
+		admin.GET("/throttle", r.getThrottle)
+		admin.PUT("/throttle", r.setThrottle)
+		admin.DELETE("/throttle", r.deleteThrottle)
+	}
+	if r.opts.Keys != nil {
+		admin.GET("/keys", r.listKeys)
+		admin.POST("/keys", r.createKey)
+		admin.GET("/keys/:id", r.getKey)
+		admin.DELETE("/keys/:id", r.deleteKey)
+	}
+}
+
+type signReq struct {
+	Link     string `json:"link" binding:"required"`
+	TTL      int64  `json:"ttl"` // seconds, 0 for the server default, -1 for never
+	MaxUses  int    `json:"max_uses"`
+	BindIP   bool   `json:"bind_ip"`
+	Filename string `json:"filename"`
+}
+
+type signResp struct {
+	Token   string `json:"token"`
+	URL     string `json:"url"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func (r routerImpl) sign(c *gin.Context) {
+	var req signReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	link, handle, ok := megalink.ParseLink(req.Link)
+	if !ok {
+		abortWithJSON(c, http.StatusBadRequest, "invalid MEGA link")
+		return
+	}
+	if megalink.FolderLinkRegex.MatchString(link) && handle == "" {
+		abortWithJSON(c, http.StatusBadRequest, "folder link must point to a file")
+		return
+	}
+	// a signed link must not let a key client out of its scopes
+	if id := auth.KeyID(c); id != "" && r.opts.Keys != nil {
+		if err := r.opts.Keys.CheckScope(id, strings.Split(link, "!")[0], handle); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	claims := &linksign.Claims{Link: link, Handle: handle, MaxUses: req.MaxUses}
+	ttl := time.Duration(req.TTL) * time.Second
+	if req.TTL == 0 {
+		ttl = r.opts.SignTTL
+	}
+	if ttl > 0 {
+		claims.Expiry = time.Now().Add(ttl).Unix()
+	}
+	if req.BindIP {
+		claims.IP = web.ClientIP(c)
+	}
+
+	token, err := r.opts.Signer.Issue(claims)
+	if err != nil {
+		c.Error(err)
+		abortWithJSON(c, http.StatusInternalServerError, "issue token failed")
+		return
+	}
+
+	p := "/s/" + token
+	if name := strings.Trim(req.Filename, "/"); name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	c.JSON(http.StatusOK, signResp{Token: token, URL: web.URL(c, p), Expires: claims.Expiry})
+}
+
+func (r routerImpl) listAliases(c *gin.Context) {
+	list, err := r.opts.Aliases.List()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !r.isAdmin(c) {
+		for i := range list {
+			list[i] = redact(list[i])
+		}
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (r routerImpl) getAlias(c *gin.Context) {
+	e, err := r.opts.Aliases.Get(c.Param("name"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !r.isAdmin(c) {
+		e = redact(e)
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// redact leaves the key out of the link, so that aliases don't hand out what signed links hide
+func redact(e alias.Entry) alias.Entry {
+	if i := strings.Index(e.Link, "!"); i >= 0 {
+		e.Link = e.Link[:i]
+	}
+	return e
+}
+
+type aliasReq struct {
+	Link string `json:"link" binding:"required"`
+}
+
+func (r routerImpl) setAlias(c *gin.Context) {
+	var req aliasReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	link, handle, ok := megalink.ParseLink(req.Link)
+	if !ok {
+		abortWithJSON(c, http.StatusBadRequest, "invalid MEGA link")
+		return
+	}
+	e, err := r.opts.Aliases.Set(alias.Entry{Name: c.Param("name"), Link: link, Handle: handle})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+func (r routerImpl) deleteAlias(c *gin.Context) {
+	if err := r.opts.Aliases.Delete(c.Param("name")); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func abortWithError(c *gin.Context, err error) {
+	err, code, msg := web.ConvertError(err)
+	c.Error(err)
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	abortWithJSON(c, code, msg)
+}
+
+func abortWithJSON(c *gin.Context, code int, msg string) {
+	c.AbortWithStatusJSON(code, gin.H{"error": msg})
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/web/auth"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRouter authenticates clients by the X-User header, remote is the client address
+func newTestRouter(t *testing.T, opts Options) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	a, err := auth.NewRouter(auth.Config{Authenticate: func(req *http.Request) (string, bool) {
+		u := req.Header.Get("X-User")
+		return u, u != ""
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Setup(e)
+	NewRouter(opts).Setup(e)
+	return e
+}
+
+func serve(e *gin.Engine, method, path, remote, user string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remote
+	req.Header.Set("X-User", user)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w
+}
+
+func TestAliasKeys(t *testing.T) {
+	aliases, err := alias.Open(filepath.Join(t.TempDir(), "aliases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const link = "abcdefgh!0123456789012345678901"
+	if _, err = aliases.Set(alias.Entry{Name: "team", Link: link, Handle: "ijklmnop"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		admins       []string
+		local        bool
+		remote, user string
+		link         string
+	}{
+		{[]string{"root"}, false, "10.0.0.1:1234", "root", link},
+		{[]string{"root"}, false, "10.0.0.1:1234", "alice", "abcdefgh"},
+		{[]string{"root"}, false, "127.0.0.1:1234", "alice", "abcdefgh"},
+		{nil, false, "127.0.0.1:1234", "alice", "abcdefgh"},
+		{nil, true, "127.0.0.1:1234", "alice", link},
+		{nil, true, "10.0.0.1:1234", "alice", "abcdefgh"},
+	} {
+		e := newTestRouter(t, Options{Aliases: aliases, Admins: c.admins, LocalAdmins: c.local})
+		var list []alias.Entry
+		w := serve(e, http.MethodGet, "/api/aliases", c.remote, c.user)
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].Link != c.link || list[0].Handle != "ijklmnop" {
+			t.Errorf("list as %s from %s: got %d %s", c.user, c.remote, w.Code, w.Body)
+		}
+		var one alias.Entry
+		w = serve(e, http.MethodGet, "/api/aliases/team", c.remote, c.user)
+		if err := json.Unmarshal(w.Body.Bytes(), &one); err != nil || one.Link != c.link {
+			t.Errorf("get as %s from %s: got %d %s", c.user, c.remote, w.Code, w.Body)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	for _, c := range []struct {
+		admins       []string
+		local        bool
+		remote, user string
+		code         int
+	}{
+		{nil, false, "127.0.0.1:1234", "alice", 403},
+		{nil, false, "[::1]:1234", "alice", 403},
+		{nil, true, "127.0.0.1:1234", "alice", 200},
+		{nil, true, "[::1]:1234", "alice", 200},
+		{nil, true, "10.0.0.1:1234", "alice", 403},
+		{[]string{"root"}, false, "10.0.0.1:1234", "root", 200},
+		{[]string{"root"}, false, "10.0.0.1:1234", "alice", 403},
+		{[]string{"root"}, false, "127.0.0.1:1234", "alice", 403},
+		{[]string{"root"}, true, "127.0.0.1:1234", "alice", 200},
+	} {
+		e := newTestRouter(t, Options{Admins: c.admins, LocalAdmins: c.local, Throttle: throttle.New(throttle.Limits{}, nil)})
+		if w := serve(e, http.MethodGet, "/api/admin/throttle", c.remote, c.user); w.Code != c.code {
+			t.Errorf("%+v: got %d", c, w.Code)
+		}
+	}
+}
+
+func TestAliasWritesRequireAdmin(t *testing.T) {
+	aliases, err := alias.Open(filepath.Join(t.TempDir(), "aliases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const link = "abcdefgh!0123456789012345678901"
+	if _, err = aliases.Set(alias.Entry{Name: "team", Link: link, Handle: "abcdefgh"}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestRouter(t, Options{Aliases: aliases, Admins: []string{"root"}})
+
+	put := func(user, name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/aliases/"+name, strings.NewReader(`{"link": "ijklmnop!0123456789012345678901"}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		return w
+	}
+	for _, w := range []*httptest.ResponseRecorder{
+		put("alice", "team"),
+		put("alice", "other"),
+		serve(e, http.MethodDelete, "/api/aliases/team", "10.0.0.1:1234", "alice"),
+	} {
+		if w.Code != http.StatusForbidden {
+			t.Errorf("non-admin write: got %d %s, want 403", w.Code, w.Body)
+		}
+	}
+	if list, err := aliases.List(); err != nil || len(list) != 1 || list[0].Name != "team" || list[0].Link != link {
+		t.Errorf("store changed by non-admins: %+v %v", list, err)
+	}
+
+	if w := put("root", "team"); w.Code != http.StatusOK {
+		t.Errorf("admin put: got %d %s", w.Code, w.Body)
+	}
+	if w := serve(e, http.MethodDelete, "/api/aliases/team", "10.0.0.1:1234", "root"); w.Code != http.StatusNoContent {
+		t.Errorf("admin delete: got %d %s", w.Code, w.Body)
+	}
+}
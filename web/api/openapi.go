@@ -0,0 +1,29 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/web"
+	"net/http"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// openAPI serves the OpenAPI 3 document of the JSON API and the download routes, its servers is the URL
+// the client reached megalink at, so that generated clients work below a base path and behind proxies
+func openAPI() gin.HandlerFunc {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		panic(err)
+	}
+	return func(c *gin.Context) {
+		d := make(map[string]interface{}, len(doc)+1)
+		for k, v := range doc {
+			d[k] = v
+		}
+		d["servers"] = []gin.H{{"url": web.URL(c, "")}}
+		c.JSON(http.StatusOK, d)
+	}
+}
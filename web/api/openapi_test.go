@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/throttle"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/dl"
+	"github.com/mocukie/megalink/web/health"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPI checks that every route is documented, with all features on
+func TestOpenAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	signer, err := linksign.NewSigner([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := alias.Open(filepath.Join(dir, "aliases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.Open(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	for _, r := range []web.IRouter{
+		health.NewRouter(health.Options{}),
+		NewRouter(Options{Signer: signer, Aliases: aliases, Throttle: throttle.New(throttle.Limits{}, nil), Keys: keys}),
+		dl.NewRouter(dl.Options{Signer: signer, Aliases: aliases}),
+	} {
+		r.Setup(e)
+	}
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://example.com/api/openapi.json", nil))
+	var doc struct {
+		Servers []struct{ URL string }
+		Paths   map[string]map[string]json.RawMessage
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body.String(), err)
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != "https://example.com" {
+		t.Errorf("servers %+v", doc.Servers)
+	}
+
+	param := regexp.MustCompile(`:(\w+)`)
+	for _, route := range e.Routes() {
+		method := strings.ToLower(route.Method)
+		p := param.ReplaceAllString(route.Path, "{$1}")
+		// catch-all tails are documented as their variants
+		prefix, catchAll := p, false
+		if i := strings.Index(p, "/*"); i >= 0 {
+			prefix, catchAll = p[:i+1], true
+		}
+		found := false
+		for path, item := range doc.Paths {
+			if (path == p || catchAll && strings.HasPrefix(path, prefix)) && item[method] != nil {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s %s is not documented", route.Method, route.Path)
+		}
+	}
+}
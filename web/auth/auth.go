@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/web"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	userKey        = "auth.user"
+	keyUserPrefix  = "key:"
+	certUserPrefix = "cert:"
+	// htpasswd users have no ':', prefixes keep the other identities apart from them and each other
+	oidcUserPrefix  = "oidc:"
+	tokenUserPrefix = "token:"
+	tokenQuery      = "token"
+	sessionCookie   = "megalink_session"
+	routePrefix     = "/auth"
+)
+
+type Config struct {
+	// htpasswd file for HTTP basic auth, bcrypt and {SHA} entries are supported
+	Htpasswd string
+	// static bearer tokens, also accepted as ?token= so downloaders can use /dl URLs
+	Tokens []string
+	// API keys, accepted like Tokens
+	Keys *apikey.Store
+	// TLS client certificates are verified by the server, their identity authenticates the
+	// client, or the API key it is bound to
+	ClientCerts bool
+	// OIDC login for the web UI, disabled when Issuer is empty
+	OIDC OIDCConfig
+	// asked before the other methods, e.g. by a service embedding megalink that has its own
+	// sessions, a client it doesn't know returns false and may still pass the others
+	Authenticate func(req *http.Request) (user string, ok bool)
+	// key of the session cookie HMAC, a random one is used if empty
+	SessionSecret string
+	SessionTTL    time.Duration
+}
+
+func (c *Config) Enabled() bool {
+	return c.Htpasswd != "" || len(c.Tokens) != 0 || c.Keys != nil || c.ClientCerts || c.OIDC.Issuer != "" || c.Authenticate != nil
+}
+
+type routerImpl struct {
+	htpasswd htpasswd
+	tokens   [][]byte
+	keys     *apikey.Store
+	certs    bool
+	hook     func(req *http.Request) (string, bool)
+	oidc     *oidcProvider
+	session  *sessionCodec
+}
+
+// NewRouter checks every request that comes after it, it must be set up before any other router
+func NewRouter(conf Config) (web.IRouter, error) {
+	r := &routerImpl{keys: conf.Keys, certs: conf.ClientCerts, hook: conf.Authenticate}
+	if conf.Htpasswd != "" {
+		h, err := loadHtpasswd(conf.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		r.htpasswd = h
+	}
+	for _, t := range conf.Tokens {
+		if t != "" {
+			r.tokens = append(r.tokens, []byte(t))
+		}
+	}
+
+	secret := []byte(conf.SessionSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errorx.Decorate(err, "generate session secret failed")
+		}
+	}
+	if conf.SessionTTL <= 0 {
+		conf.SessionTTL = 24 * time.Hour
+	}
+	r.session = &sessionCodec{secret: secret, ttl: conf.SessionTTL}
+
+	if conf.OIDC.Issuer != "" {
+		p, err := newOIDCProvider(conf.OIDC, http.DefaultClient)
+		if err != nil {
+			return nil, err
+		}
+		r.oidc = p
+	}
+	return r, nil
+}
+
+func (r *routerImpl) Setup(g gin.IRouter) {
+	g.Use(r.authenticate)
+	if r.oidc != nil {
+		g.Group(routePrefix).
+			GET("/login", r.login).
+			GET("/callback", r.callback).
+			GET("/logout", r.logout)
+	}
+}
+
+// User returns the name of the authenticated client, empty when auth is disabled
+func User(c *gin.Context) string {
+	return c.GetString(userKey)
+}
+
+// KeyID returns the id of the API key the client authenticated with, empty for other clients
+func KeyID(c *gin.Context) string {
+	if u := User(c); strings.HasPrefix(u, keyUserPrefix) {
+		return u[len(keyUserPrefix):]
+	}
+	return ""
+}
+
+// CertIdentity returns the common name of the verified TLS client certificate, or else its first
+// e-mail address or DNS name, empty without a verified certificate
+func CertIdentity(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := req.TLS.VerifiedChains[0][0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName
+	case len(leaf.EmailAddresses) != 0:
+		return leaf.EmailAddresses[0]
+	case len(leaf.DNSNames) != 0:
+		return leaf.DNSNames[0]
+	}
+	return ""
+}
+
+func (r *routerImpl) authenticate(c *gin.Context) {
+	if r.oidc != nil && strings.HasPrefix(c.Request.URL.Path, routePrefix+"/") {
+		c.Next()
+		return
+	}
+
+	if user, ok := r.identify(c); ok {
+		c.Set(userKey, user)
+		c.Next()
+		return
+	}
+
+	if r.oidc != nil && c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusFound, web.Prefix(c)+routePrefix+"/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+		return
+	}
+
+	if r.htpasswd != nil {
+		c.Header("WWW-Authenticate", `Basic realm="megalink", charset="UTF-8"`)
+	} else {
+		c.Header("WWW-Authenticate", `Bearer realm="megalink"`)
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+func (r *routerImpl) identify(c *gin.Context) (string, bool) {
+	if r.hook != nil {
+		if user, ok := r.hook(c.Request); ok {
+			return user, true
+		}
+	}
+
+	if h := c.GetHeader("Authorization"); h != "" {
+		if user, pass, ok := c.Request.BasicAuth(); ok {
+			return user, r.htpasswd.verify(user, pass)
+		}
+		if strings.HasPrefix(h, "Bearer ") {
+			return r.checkToken(strings.TrimSpace(h[len("Bearer "):]))
+		}
+		return "", false
+	}
+
+	if t := c.Query(tokenQuery); t != "" {
+		return r.checkToken(t)
+	}
+
+	if id := CertIdentity(c.Request); r.certs && id != "" {
+		if r.keys != nil {
+			if k, ok := r.keys.ByCert(id); ok {
+				return keyUserPrefix + k.ID, true
+			}
+		}
+		return certUserPrefix + id, true
+	}
+
+	// sessions only come from OIDC logins, those of before the prefix are void
+	if v, err := c.Cookie(sessionCookie); err == nil {
+		if user, ok := r.session.decode(v); ok && strings.HasPrefix(user, oidcUserPrefix) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func (r *routerImpl) checkToken(t string) (string, bool) {
+	for _, tok := range r.tokens {
+		if subtle.ConstantTimeCompare(tok, []byte(t)) == 1 {
+			// never expose the token itself as identity
+			return tokenUserPrefix + tokenID(tok), true
+		}
+	}
+	if r.keys != nil {
+		if k, ok := r.keys.Authenticate(t); ok {
+			return keyUserPrefix + k.ID, true
+		}
+	}
+	return "", false
+}
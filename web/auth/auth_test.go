@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/apikey"
+)
+
+func newTestServer(t *testing.T, conf Config) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r, err := NewRouter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	r.Setup(e)
+	e.GET("/whoami", func(c *gin.Context) {
+		c.String(200, User(c))
+	})
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, client *http.Client, u string, header http.Header) (int, string) {
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestBasicAndToken(t *testing.T) {
+	// alice:secret (bcrypt), bob:secret ({SHA})
+	f := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(f, []byte("# users\n"+
+		"alice:$2a$05$ShIJEUfj5NcxrraX3J76OeOhezE36xDuy.0Mkz3T4NWD2/QR1tEya\n"+
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, Config{Htpasswd: f, Tokens: []string{"tok3n"}})
+	c := srv.Client()
+
+	for _, tc := range []struct {
+		path   string
+		header http.Header
+		code   int
+	}{
+		{"/whoami", nil, 401},
+		{"/whoami", http.Header{"Authorization": {"Basic YWxpY2U6c2VjcmV0"}}, 200},
+		{"/whoami", http.Header{"Authorization": {"Basic Ym9iOnNlY3JldA=="}}, 200},
+		{"/whoami", http.Header{"Authorization": {"Basic YWxpY2U6d3Jvbmc="}}, 401},
+		{"/whoami", http.Header{"Authorization": {"Bearer tok3n"}}, 200},
+		{"/whoami", http.Header{"Authorization": {"Bearer wrong"}}, 401},
+		{"/whoami?token=tok3n", nil, 200},
+		{"/whoami?token=wrong", nil, 401},
+	} {
+		if code, body := get(t, c, srv.URL+tc.path, tc.header); code != tc.code {
+			t.Errorf("%s %v: got %d %q, want %d", tc.path, tc.header, code, body, tc.code)
+		}
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys, err := apikey.Open(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _, err := keys.Create("backup", apikey.Limits{}, nil, []string{"backup@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter(Config{ClientCerts: true, Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	r.Setup(e)
+	e.GET("/whoami", func(c *gin.Context) {
+		c.String(200, User(c)+" "+KeyID(c))
+	})
+
+	for i, tc := range []struct {
+		cert *x509.Certificate
+		code int
+		body string
+	}{
+		{nil, 401, ""},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}, 200, "cert:alice "},
+		{&x509.Certificate{DNSNames: []string{"ci.example.com"}}, 200, "cert:ci.example.com "},
+		{&x509.Certificate{EmailAddresses: []string{"backup@example.com"}}, 200, "key:" + k.ID + " " + k.ID},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		if tc.cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tc.cert}}}
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != tc.code || tc.code == 200 && w.Body.String() != tc.body {
+			t.Errorf("#%d: got %d %q, want %d %q", i, w.Code, w.Body.String(), tc.code, tc.body)
+		}
+	}
+}
+
+// stand-in OIDC provider which logs everyone in as the given user, subject 1, who calls himself admin
+func newTestProvider(t *testing.T, clientID, email string, verified interface{}) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv *httptest.Server
+	var nonce string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": b64.EncodeToString(key.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		nonce = q.Get("nonce")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=c0de&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, _, _ := r.BasicAuth(); id != clientID || r.FormValue("code") != "c0de" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss": srv.URL, "sub": "1", "aud": clientID, "email": email, "email_verified": verified, "nonce": nonce,
+			"preferred_username": "admin",
+			"exp":                time.Now().Add(time.Minute).Unix(),
+		})
+		signed := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+		digest := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + b64.EncodeToString(sig)})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOIDC(t *testing.T) {
+	provider := newTestProvider(t, "megalink", "alice@example.com", true)
+	srv := newTestServer(t, Config{OIDC: OIDCConfig{
+		Issuer:   provider.URL,
+		ClientID: "megalink",
+		Users:    []string{"alice@example.com"},
+	}})
+
+	jar, _ := cookiejar.New(nil)
+	c := &http.Client{Jar: jar}
+	html := http.Header{"Accept": {"text/html"}}
+
+	if code, _ := get(t, &http.Client{}, srv.URL+"/whoami", nil); code != 401 {
+		t.Errorf("api request without session: got %d, want 401", code)
+	}
+	code, body := get(t, c, srv.URL+"/whoami", html)
+	if code != 200 || body != "oidc:alice@example.com" {
+		t.Errorf("browser login: got %d %q", code, body)
+	}
+	if code, _ = get(t, c, srv.URL+"/whoami", nil); code != 200 {
+		t.Errorf("session cookie: got %d, want 200", code)
+	}
+
+	denied := newTestProvider(t, "megalink", "mallory@example.com", true)
+	srv = newTestServer(t, Config{OIDC: OIDCConfig{
+		Issuer:   denied.URL,
+		ClientID: "megalink",
+		Users:    []string{"alice@example.com"},
+	}})
+	jar, _ = cookiejar.New(nil)
+	if code, _ = get(t, &http.Client{Jar: jar}, srv.URL+"/whoami", html); code != 403 {
+		t.Errorf("user not allowed: got %d, want 403", code)
+	}
+
+	// an unverified email is not used, the subject is, never the preferred_username
+	for _, verified := range []interface{}{false, "false", nil} {
+		unverified := newTestProvider(t, "megalink", "alice@example.com", verified)
+		srv = newTestServer(t, Config{OIDC: OIDCConfig{
+			Issuer:   unverified.URL,
+			ClientID: "megalink",
+			Users:    []string{"alice@example.com"},
+		}})
+		jar, _ = cookiejar.New(nil)
+		if code, _ = get(t, &http.Client{Jar: jar}, srv.URL+"/whoami", html); code != 403 {
+			t.Errorf("email_verified %v: got %d, want 403", verified, code)
+		}
+	}
+	verified := newTestProvider(t, "megalink", "alice@example.com", "true")
+	srv = newTestServer(t, Config{OIDC: OIDCConfig{Issuer: verified.URL, ClientID: "megalink"}})
+	jar, _ = cookiejar.New(nil)
+	if code, body = get(t, &http.Client{Jar: jar}, srv.URL+"/whoami", html); code != 200 || body != "oidc:alice@example.com" {
+		t.Errorf("email_verified as string: got %d %q", code, body)
+	}
+	unverified := newTestProvider(t, "megalink", "alice@example.com", false)
+	srv = newTestServer(t, Config{OIDC: OIDCConfig{Issuer: unverified.URL, ClientID: "megalink"}})
+	jar, _ = cookiejar.New(nil)
+	if code, body = get(t, &http.Client{Jar: jar}, srv.URL+"/whoami", html); code != 200 || body != "oidc:1" {
+		t.Errorf("unverified email: got %d %q, want subject 1", code, body)
+	}
+}
+
+// TestIdentityNamespaces logs in OIDC accounts whose verified email is the identity of
+// another client, none of them may be authenticated as it or charge an API key
+func TestIdentityNamespaces(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	// alice:secret
+	htpasswd := filepath.Join(dir, "htpasswd")
+	err := os.WriteFile(htpasswd, []byte("alice:$2a$05$ShIJEUfj5NcxrraX3J76OeOhezE36xDuy.0Mkz3T4NWD2/QR1tEya\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.Open(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, secret, err := keys.Create("backup", apikey.Limits{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEngine := func(issuer string) *gin.Engine {
+		r, err := NewRouter(Config{
+			Htpasswd:    htpasswd,
+			Tokens:      []string{"tok3n"},
+			Keys:        keys,
+			ClientCerts: true,
+			OIDC:        OIDCConfig{Issuer: issuer, ClientID: "megalink"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := gin.New()
+		r.Setup(e)
+		e.GET("/whoami", func(c *gin.Context) {
+			c.String(200, User(c)+" "+KeyID(c))
+		})
+		return e
+	}
+
+	e := newEngine(newTestProvider(t, "megalink", "alice@example.com", true).URL)
+	identities := map[string]bool{}
+	for _, auth := range []string{"Basic YWxpY2U6c2VjcmV0", "Bearer tok3n", "Bearer " + secret, ""} {
+		req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		} else {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}}
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%q: got %d", auth, w.Code)
+		}
+		identities[strings.Fields(w.Body.String())[0]] = true
+	}
+	if want := map[string]bool{"alice": true, "token:" + tokenID([]byte("tok3n")): true, "key:" + k.ID: true, "cert:alice": true}; !reflect.DeepEqual(identities, want) {
+		t.Fatalf("identities %v, want %v", identities, want)
+	}
+
+	for id := range identities {
+		srv := httptest.NewServer(newEngine(newTestProvider(t, "megalink", id, true).URL))
+		jar, _ := cookiejar.New(nil)
+		code, body := get(t, &http.Client{Jar: jar}, srv.URL+"/whoami", http.Header{"Accept": {"text/html"}})
+		srv.Close()
+		if code != 200 || body != "oidc:"+id+" " {
+			t.Errorf("oidc email %s: got %d %q, want %q", id, code, body, "oidc:"+id+" ")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+// htpasswd maps user to password hash
+type htpasswd map[string]string
+
+func loadHtpasswd(file string) (htpasswd, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errorx.Decorate(err, "open htpasswd failed")
+	}
+	defer f.Close()
+
+	h := make(htpasswd)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("htpasswd %s:%d: missing ':'", file, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("htpasswd %s:%d: unsupported hash of user %q, use bcrypt (htpasswd -B)", file, n, user)
+		}
+		h[user] = hash
+	}
+	if err = s.Err(); err != nil {
+		return nil, errorx.Decorate(err, "read htpasswd failed")
+	}
+	return h, nil
+}
+
+func (h htpasswd) verify(user, pass string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+func tokenID(tok []byte) string {
+	sum := sha256.Sum256(tok)
+	return hex.EncodeToString(sum[:4])
+}
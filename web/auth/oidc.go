@@ -0,0 +1,393 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/web"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCookie   = "megalink_oidc"
+	jwksMinFetch = time.Minute
+)
+
+var (
+	errInvalidIDToken = errors.New("invalid id token")
+	errUnknownKey     = errors.New("unknown id token signing key")
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// callback URL registered at the provider, derived from the request when empty
+	RedirectURL string
+	// verified email or sub values allowed to login, anyone the provider accepts if empty
+	Users []string
+}
+
+type oidcProvider struct {
+	conf     OIDCConfig
+	client   *http.Client
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+}
+
+func newOIDCProvider(conf OIDCConfig, client *http.Client) (*oidcProvider, error) {
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JwksURL  string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(conf.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(client, wellKnown, &doc); err != nil {
+		return nil, errorx.Decorate(err, "oidc discovery failed")
+	}
+	if doc.Issuer != conf.Issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch, configured %q, provider reports %q", conf.Issuer, doc.Issuer)
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.JwksURL == "" {
+		return nil, errors.New("oidc discovery document lacks required endpoints")
+	}
+	return &oidcProvider{
+		conf:     conf,
+		client:   client,
+		authURL:  doc.AuthURL,
+		tokenURL: doc.TokenURL,
+		jwksURL:  doc.JwksURL,
+	}, nil
+}
+
+func getJSON(client *http.Client, u string, v interface{}) error {
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 18)
+	_, _ = rand.Read(b)
+	return b64.EncodeToString(b)
+}
+
+func redirectURL(c *gin.Context, conf *OIDCConfig) string {
+	if conf.RedirectURL != "" {
+		return conf.RedirectURL
+	}
+	return web.URL(c, routePrefix+"/callback")
+}
+
+func (r *routerImpl) setCookie(c *gin.Context, name, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     web.Prefix(c) + "/",
+		MaxAge:   maxAge,
+		Secure:   web.Scheme(c) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (r *routerImpl) login(c *gin.Context) {
+	next := c.Query("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	state, nonce := randomString(), randomString()
+	r.setCookie(c, oidcCookie, r.session.encodeWith(oidcCookie, state+" "+nonce+" "+next, time.Now().Add(10*time.Minute)), 600)
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {r.oidc.conf.ClientID},
+		"redirect_uri":  {redirectURL(c, &r.oidc.conf)},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(r.oidc.authURL, "?") {
+		sep = "&"
+	}
+	c.Redirect(http.StatusFound, r.oidc.authURL+sep+q.Encode())
+}
+
+func (r *routerImpl) callback(c *gin.Context) {
+	v, err := c.Cookie(oidcCookie)
+	if err != nil {
+		c.String(http.StatusBadRequest, "login session expired")
+		return
+	}
+	stored, ok := r.session.decodeWith(oidcCookie, v)
+	p := strings.SplitN(stored, " ", 3)
+	if !ok || len(p) != 3 || c.Query("state") != p[0] {
+		c.String(http.StatusBadRequest, "invalid login state")
+		return
+	}
+	r.setCookie(c, oidcCookie, "", -1)
+
+	if e := c.Query("error"); e != "" {
+		c.String(http.StatusForbidden, "login failed: "+e)
+		return
+	}
+
+	user, err := r.oidc.exchange(c.Query("code"), redirectURL(c, &r.oidc.conf), p[1])
+	if err != nil {
+		_ = c.Error(err)
+		c.String(http.StatusForbidden, "login failed")
+		return
+	}
+	if !r.oidc.allowed(user) {
+		c.String(http.StatusForbidden, "user %s is not allowed", user)
+		return
+	}
+
+	r.setCookie(c, sessionCookie, r.session.encode(oidcUserPrefix+user, time.Now()), int(r.session.ttl.Seconds()))
+	c.Redirect(http.StatusFound, web.Prefix(c)+p[2])
+}
+
+func (r *routerImpl) logout(c *gin.Context) {
+	r.setCookie(c, sessionCookie, "", -1)
+	c.Redirect(http.StatusFound, web.Prefix(c)+"/")
+}
+
+func (p *oidcProvider) allowed(user string) bool {
+	if len(p.conf.Users) == 0 {
+		return true
+	}
+	for _, u := range p.conf.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange redeems the authorization code and returns the verified email, or else the subject,
+// the authenticated user is it prefixed by oidcUserPrefix
+func (p *oidcProvider) exchange(code, redirect, nonce string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirect},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.conf.ClientID), url.QueryEscape(p.conf.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errorx.Decorate(err, "oidc token request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token endpoint: %s", resp.Status)
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", errorx.Decorate(err, "decode token response failed")
+	}
+
+	claims, err := p.verify(tok.IDToken, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if claims.Nonce != nonce {
+		return "", errorx.Decorate(errInvalidIDToken, "nonce mismatch")
+	}
+	// anyone may enter any address at some providers, so an unverified email is no identity,
+	// neither is preferred_username which users pick themselves
+	if claims.Email != "" && bool(claims.EmailVerified) {
+		return claims.Email, nil
+	}
+	if claims.Subject == "" {
+		return "", errorx.Decorate(errInvalidIDToken, "missing subject")
+	}
+	return claims.Subject, nil
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// claimBool is a boolean claim, some providers send it as the string "true"
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	*b = strings.Trim(string(data), `"`) == "true"
+	return nil
+}
+
+type idClaims struct {
+	Issuer        string    `json:"iss"`
+	Subject       string    `json:"sub"`
+	Audience      audience  `json:"aud"`
+	Expiry        int64     `json:"exp"`
+	Nonce         string    `json:"nonce"`
+	Email         string    `json:"email"`
+	EmailVerified claimBool `json:"email_verified"`
+}
+
+func (p *oidcProvider) verify(raw string, now time.Time) (claims idClaims, err error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, errorx.Decorate(errInvalidIDToken, "malformed jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = decodeSegment(parts[0], &header); err != nil {
+		return
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return claims, errorx.Decorate(errInvalidIDToken, "malformed signature")
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return claims, errorx.Decorate(errInvalidIDToken, "bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return claims, errorx.Decorate(errInvalidIDToken, "bad signature")
+		}
+	default:
+		return claims, errorx.Decorate(errInvalidIDToken, "unsupported alg "+header.Alg)
+	}
+
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return
+	}
+	if claims.Issuer != p.conf.Issuer {
+		return claims, errorx.Decorate(errInvalidIDToken, "issuer mismatch")
+	}
+	var audOK bool
+	for _, a := range claims.Audience {
+		audOK = audOK || a == p.conf.ClientID
+	}
+	if !audOK {
+		return claims, errorx.Decorate(errInvalidIDToken, "audience mismatch")
+	}
+	if now.Unix() >= claims.Expiry {
+		return claims, errorx.Decorate(errInvalidIDToken, "expired")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := b64.DecodeString(seg)
+	if err != nil {
+		return errorx.Decorate(errInvalidIDToken, "malformed jwt segment")
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return errorx.Decorate(errInvalidIDToken, "malformed jwt json")
+	}
+	return nil
+}
+
+// key looks up the signing key, the JWKS is refetched on unknown kid to follow key rotation
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetch) < jwksMinFetch {
+		return nil, errUnknownKey
+	}
+	p.keysFetch = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(p.client, p.jwksURL, &set); err != nil {
+		return nil, errorx.Decorate(err, "fetch oidc jwks failed")
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := b64.DecodeString(k.N)
+			e, err2 := b64.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, err1 := b64.DecodeString(k.X)
+			y, err2 := b64.DecodeString(k.Y)
+			if err1 != nil || err2 != nil || k.Crv != "P-256" {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	p.keys = keys
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errUnknownKey
+}
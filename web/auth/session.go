@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// sessionCodec signs cookie values as base64(value).expiry.base64(hmac), the cookie
+// name is part of the MAC so a value can't be replayed under another cookie
+type sessionCodec struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func (s *sessionCodec) sign(purpose, payload string) string {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(purpose))
+	m.Write([]byte{0})
+	m.Write([]byte(payload))
+	return b64.EncodeToString(m.Sum(nil))
+}
+
+func (s *sessionCodec) encode(user string, now time.Time) string {
+	return s.encodeWith(sessionCookie, user, now.Add(s.ttl))
+}
+
+func (s *sessionCodec) decode(v string) (string, bool) {
+	return s.decodeWith(sessionCookie, v)
+}
+
+func (s *sessionCodec) encodeWith(purpose, value string, exp time.Time) string {
+	payload := b64.EncodeToString([]byte(value)) + "." + strconv.FormatInt(exp.Unix(), 10)
+	return payload + "." + s.sign(purpose, payload)
+}
+
+func (s *sessionCodec) decodeWith(purpose, v string) (string, bool) {
+	i := strings.LastIndex(v, ".")
+	if i < 0 || !hmac.Equal([]byte(v[i+1:]), []byte(s.sign(purpose, v[:i]))) {
+		return "", false
+	}
+	p := strings.SplitN(v[:i], ".", 2)
+	if len(p) != 2 {
+		return "", false
+	}
+	exp, err := strconv.ParseInt(p[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", false
+	}
+	value, err := b64.DecodeString(p[0])
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
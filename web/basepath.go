@@ -0,0 +1,100 @@
+package web
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+type basePathKey struct{}
+
+// CleanBasePath returns p as /a/b, empty for the root
+func CleanBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// StripBasePath serves h under base, requests outside of it are not found and base itself is
+// redirected to base/. The routers of h see paths without base, Prefix gives it back.
+func StripBasePath(base string, h http.Handler) http.Handler {
+	base = CleanBasePath(base)
+	if base == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := req.URL.Path
+		if p == base {
+			u := base + "/"
+			if req.URL.RawQuery != "" {
+				u += "?" + req.URL.RawQuery
+			}
+			http.Redirect(w, req, u, http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(p, base+"/") {
+			http.NotFound(w, req)
+			return
+		}
+
+		r := req.WithContext(context.WithValue(req.Context(), basePathKey{}, base))
+		u := *req.URL
+		u.Path = p[len(base):]
+		if strings.HasPrefix(u.RawPath, base+"/") {
+			u.RawPath = u.RawPath[len(base):]
+		} else {
+			u.RawPath = ""
+		}
+		r.URL = &u
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Prefix returns the path the routes are published under, X-Forwarded-Prefix of a trusted proxy
+// or else the base path, empty for the root
+func Prefix(c *gin.Context) string {
+	if p := forwarded(c, "X-Forwarded-Prefix"); strings.HasPrefix(p, "/") {
+		return CleanBasePath(p)
+	}
+	base, _ := c.Request.Context().Value(basePathKey{}).(string)
+	return base
+}
+
+// Scheme returns http or https as seen by the client, X-Forwarded-Proto is honored from trusted proxies
+func Scheme(c *gin.Context) string {
+	if p := strings.ToLower(forwarded(c, "X-Forwarded-Proto")); p == "http" || p == "https" {
+		return p
+	}
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Host returns the host the client asked for, X-Forwarded-Host is honored from trusted proxies
+func Host(c *gin.Context) string {
+	if h := forwarded(c, "X-Forwarded-Host"); h != "" {
+		return h
+	}
+	return c.Request.Host
+}
+
+// URL returns the absolute URL of path, a route path without the base path
+func URL(c *gin.Context, path string) string {
+	return Scheme(c) + "://" + Host(c) + Prefix(c) + path
+}
+
+// forwarded returns the first value of header when the peer is a trusted proxy
+func forwarded(c *gin.Context, header string) string {
+	if !c.GetBool(proxiedKey) {
+		return ""
+	}
+	v := c.GetHeader(header)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/netutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripBasePath(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	trusted, _ := netutil.ParseNets([]string{"10.0.0.1"})
+	e := gin.New()
+	e.Use(RealIP(trusted, false))
+	e.GET("/s/:token", func(c *gin.Context) {
+		c.String(http.StatusOK, URL(c, c.Request.URL.Path))
+	})
+	h := StripBasePath("megalink/", e)
+
+	for i, tc := range []struct {
+		path, peer string
+		header     map[string]string
+		code       int
+		body       string
+	}{
+		{"/megalink/s/t", "192.0.2.1:1234", nil, 200, "http://example.com/megalink/s/t"},
+		{"/megalink/s/t", "192.0.2.1:1234", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Prefix": "/evil"}, 200, "http://example.com/megalink/s/t"},
+		{"/megalink/s/t", "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "tools.example.com"}, 200, "https://tools.example.com/megalink/s/t"},
+		{"/megalink/s/t", "10.0.0.1:1234", map[string]string{"X-Forwarded-Prefix": "/tools/megalink/"}, 200, "http://example.com/tools/megalink/s/t"},
+		{"/s/t", "192.0.2.1:1234", nil, 404, ""},
+		{"/megalinks/s/t", "192.0.2.1:1234", nil, 404, ""},
+		{"/megalink", "192.0.2.1:1234", nil, 301, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+tc.path, nil)
+		req.RemoteAddr = tc.peer
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.code || tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("#%d: got %d %q, want %d %q", i, w.Code, w.Body.String(), tc.code, tc.body)
+		}
+		if tc.code == 301 && w.Header().Get("Location") != "/megalink/" {
+			t.Errorf("#%d: redirected to %q", i, w.Header().Get("Location"))
+		}
+	}
+
+	if StripBasePath("/", e) != http.Handler(e) {
+		t.Error("root base path not served as is")
+	}
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/netutil"
+	"net"
+	"strings"
+)
+
+const (
+	clientIPKey = "client.ip"
+	// the peer is a trusted proxy, its X-Forwarded-* headers are honored
+	proxiedKey = "client.proxied"
+)
+
+// RealIP resolves the client address, X-Forwarded-For and X-Real-IP are only honored
+// when the peer is one of the trusted proxies, the forwarded chain is walked from the
+// right and the first untrusted hop is the client. Peers on Unix sockets are trusted too
+// with unix set, then the socket permissions decide who may connect. X-Forwarded-Proto,
+// -Host and -Prefix of trusted proxies are honored by Scheme, Host and Prefix.
+func RealIP(trusted []*net.IPNet, unix bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := remoteIP(c.Request.RemoteAddr)
+		if unix && isUnixPeer(c.Request.RemoteAddr) || len(trusted) != 0 && isTrusted(trusted, ip) {
+			c.Set(proxiedKey, true)
+			if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
+				hops := strings.Split(xff, ",")
+				for i := len(hops) - 1; i >= 0; i-- {
+					hop := strings.TrimSpace(hops[i])
+					if net.ParseIP(hop) == nil {
+						break
+					}
+					ip = hop
+					if !isTrusted(trusted, hop) {
+						break
+					}
+				}
+			} else if xri := strings.TrimSpace(c.GetHeader("X-Real-IP")); net.ParseIP(xri) != nil {
+				ip = xri
+			}
+		}
+		c.Set(clientIPKey, ip)
+		c.Next()
+	}
+}
+
+// ClientIP returns the address resolved by RealIP, or the peer address without it
+func ClientIP(c *gin.Context) string {
+	if ip := c.GetString(clientIPKey); ip != "" {
+		return ip
+	}
+	return remoteIP(c.Request.RemoteAddr)
+}
+
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// peers of Unix sockets have no address, net/http shows them as "@" on Linux. An empty address
+// may be anything, e.g. a request made up by an embedding service, so it is never trusted.
+func isUnixPeer(addr string) bool {
+	return addr == "@"
+}
+
+func isTrusted(trusted []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && netutil.Contains(trusted, addr)
+}
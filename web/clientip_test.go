@@ -0,0 +1,46 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/netutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	trusted, _ := netutil.ParseNets([]string{"10.0.0.1"})
+	for i, tc := range []struct {
+		unix       bool
+		peer, xff  string
+		ip, scheme string
+	}{
+		{false, "192.0.2.1:1234", "198.51.100.1", "192.0.2.1", "http"},
+		{false, "10.0.0.1:1234", "198.51.100.1", "198.51.100.1", "https"},
+		{false, "10.0.0.1:1234", "198.51.100.1, 10.0.0.1", "198.51.100.1", "https"},
+		{false, "10.0.0.1:1234", "garbage", "10.0.0.1", "https"},
+		// Unix socket peers only with unix set
+		{false, "@", "198.51.100.1", "@", "http"},
+		{true, "@", "198.51.100.1", "198.51.100.1", "https"},
+		{true, "192.0.2.1:1234", "198.51.100.1", "192.0.2.1", "http"},
+		// an empty peer is never trusted
+		{false, "", "198.51.100.1", "", "http"},
+		{true, "", "198.51.100.1", "", "http"},
+	} {
+		e := gin.New()
+		e.Use(RealIP(trusted, tc.unix))
+		e.GET("/", func(c *gin.Context) {
+			c.String(http.StatusOK, ClientIP(c)+" "+Scheme(c))
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.peer
+		req.Header.Set("X-Forwarded-For", tc.xff)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if want := tc.ip + " " + tc.scheme; w.Body.String() != want {
+			t.Errorf("#%d: got %q, want %q", i, w.Body.String(), want)
+		}
+	}
+}
@@ -1,42 +1,262 @@
 package dl
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/linksign"
 	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/megalink"
+	"github.com/mocukie/megalink/pkg/policy"
+	"github.com/mocukie/megalink/pkg/throttle"
 	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/auth"
+	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var rangeRegex = regexp.MustCompile("^bytes=(\\d+)-(\\d*)$")
-var megaClient = web.MegaClient
+type Options struct {
+	// MEGA client of the lookups and downloads, default web.MegaClient
+	Client *mega.Client
+	// fetch upstream with several concurrent connections when Segment.Conns > 1
+	Segment mega.Segmented
+	// serve /s/:token signed links when not nil
+	Signer *linksign.Signer
+	// disable /dl/:link so that keys never appear in URLs
+	SignedOnly bool
+	// serve /a/:alias when not nil
+	Aliases *alias.Store
+	// access policy checked before links are resolved, nil allows everything
+	Policy *policy.Engine
+	// run before a link is resolved, e.g. rate limiting
+	Lookup []gin.HandlerFunc
+	// wrap GET downloads, e.g. concurrent stream limiting
+	Transfer []gin.HandlerFunc
+	// bandwidth limits of the decrypted streams, nil for unlimited
+	Throttle *throttle.Throttle
+	// restrict API key clients to the scopes of their keys when not nil
+	Keys *apikey.Store
+}
+
+type routerImpl struct {
+	opts Options
+}
 
-type routerImpl struct{}
+func NewRouter(opts Options) web.IRouter {
+	if opts.Client == nil {
+		opts.Client = web.MegaClient
+	}
+	return routerImpl{opts: opts}
+}
 
-func NewRouter() web.IRouter {
-	return routerImpl{}
+// chain builds the HEAD and GET handler chains of a route resolved by parse
+func (r routerImpl) chain(parse gin.HandlerFunc) (headChain, getChain []gin.HandlerFunc) {
+	headChain = append(append(headChain, r.opts.Lookup...), parse, head)
+	getChain = append(append(append(getChain, r.opts.Lookup...), parse), r.opts.Transfer...)
+	getChain = append(getChain, r.download)
+	return
 }
 
 func (r routerImpl) Setup(g gin.IRouter) {
+	if r.opts.Signer != nil {
+		s := g.Group("/s")
+		headChain, getChain := r.chain(r.parseSignedLink)
+		s.Group("/:token").
+			HEAD("", headChain...).
+			GET("", getChain...)
+		s.Group("/:token/*path").
+			HEAD("", headChain...).
+			GET("", getChain...)
+	}
+	if r.opts.Aliases != nil {
+		a := g.Group("/a")
+		headChain, getChain := r.chain(r.parseAliasLink)
+		a.Group("/:alias").
+			HEAD("", headChain...).
+			GET("", getChain...)
+		a.Group("/:alias/*path").
+			HEAD("", headChain...).
+			GET("", getChain...)
+	}
+	if r.opts.SignedOnly {
+		return
+	}
+
 	g = g.Group("/dl")
+	headChain, getChain := r.chain(r.parseLink)
+	// /:link, /:link/:filename, /:link/file/:handle and /:link/file/:handle/:filename,
+	// the router can't mix static and param segments, so the tail is split by parseLink
 	g.Group("/:link").
-		HEAD("", parseFileLink).
-		GET("", parseFileLink, download)
-	g.Group("/:link/file/:handle").
-		HEAD("", parseFolderFileLink).
-		GET("", parseFolderFileLink, download)
+		HEAD("", headChain...).
+		GET("", getChain...)
+	g.Group("/:link/*path").
+		HEAD("", headChain...).
+		GET("", getChain...)
 }
 
-func parseFileLink(c *gin.Context) {
+// parseSignedLink resolves /s/:token[/:filename], the uses are counted by download
+func (r routerImpl) parseSignedLink(c *gin.Context) {
+	claims, err := r.opts.Signer.Open(c.Param("token"), time.Now())
+	if err == nil {
+		err = claims.Check(web.ClientIP(c))
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Set("claims", claims)
+
+	if name := strings.Trim(c.Param("path"), "/"); name != "" {
+		c.Set("filename", name)
+	}
+	if claims.Handle != "" {
+		r.parseFolderFileLink(c, claims.Link, claims.Handle)
+	} else {
+		r.parseFileLink(c, claims.Link)
+	}
+}
+
+// parseAliasLink resolves /a/:alias[/*path], path is the filename of a file alias,
+// or the path of a file inside a folder alias
+func (r routerImpl) parseAliasLink(c *gin.Context) {
+	e, err := r.opts.Aliases.Get(c.Param("alias"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	p := strings.Trim(c.Param("path"), "/")
+	if !megalink.FolderLinkRegex.MatchString(e.Link) {
+		if strings.Contains(p, "/") {
+			c.AbortWithStatus(404)
+			return
+		}
+		if p != "" {
+			c.Set("filename", p)
+		}
+		r.parseFileLink(c, e.Link)
+		return
+	}
+
+	if e.Handle != "" {
+		if p != "" {
+			c.Set("filename", path.Base(p))
+		}
+		r.parseFolderFileLink(c, e.Link, e.Handle)
+		return
+	}
+
+	// the file handle is only known once the folder is open, the folder is checked before
+	// so that denied clients can't make api requests or probe paths
+	g := strings.Split(e.Link, "!")
+	if !r.allow(c, g[0]) {
+		return
+	}
+	fm, err := r.opts.Client.OpenPublicFolderContext(c.Request.Context(), g[0], g[1])
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	node := fm.LookupNamePath(p)
+	if node == nil || node.Type != mega.TypeFile {
+		c.AbortWithStatus(404)
+		return
+	}
+	if !r.allow(c, g[0], node.Handle) {
+		return
+	}
+	r.serveFolderNode(c, fm, node)
+}
+
+// allow checks the client and the link handles against the access policy and the scopes
+// of the client API key, the request is aborted when denied
+func (r routerImpl) allow(c *gin.Context, handles ...string) bool {
+	var err error
+	if r.opts.Policy != nil {
+		err = r.opts.Policy.CheckClient(web.ClientIP(c), c.GetHeader("Referer"))
+		if err == nil {
+			err = r.opts.Policy.CheckHandles(handles...)
+		}
+	}
+	if id := auth.KeyID(c); err == nil && id != "" && r.opts.Keys != nil {
+		err = r.opts.Keys.CheckScope(id, handles...)
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	return true
+}
+
+func (r routerImpl) allowNode(c *gin.Context, info *mega.NodeInfo) bool {
+	if r.opts.Policy == nil {
+		return true
+	}
+	if err := r.opts.Policy.CheckNode(info.Owner, info.Size); err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	return true
+}
+
+// useSignedLink consumes a use of the signed link of the request, if any, for the bytes it sends,
+// downloads of disjoint parts of the file share a use, see linksign.Signer.Use
+func (r routerImpl) useSignedLink(c *gin.Context, info *mega.NodeInfo, ranges []httpRange) bool {
+	claims, ok := c.Get("claims")
+	if !ok {
+		return true
+	}
+	spans := []linksign.Span{{Start: 0, End: info.Size}}
+	if len(ranges) != 0 {
+		spans = spans[:0]
+		for _, ra := range ranges {
+			spans = append(spans, linksign.Span{Start: ra.start, End: ra.start + ra.length})
+		}
+	}
+	if err := r.opts.Signer.Use(claims.(*linksign.Claims), spans, time.Now()); err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	return true
+}
+
+func (r routerImpl) parseLink(c *gin.Context) {
 	link := c.Param("link")
+	p := strings.Split(strings.TrimPrefix(c.Param("path"), "/"), "/")
+	if megalink.FolderLinkRegex.MatchString(link) {
+		if len(p) < 2 || len(p) > 3 || p[0] != "file" {
+			c.AbortWithStatus(404)
+			return
+		}
+		if len(p) == 3 {
+			c.Set("filename", p[2])
+		}
+		r.parseFolderFileLink(c, link, p[1])
+		return
+	}
+
+	if len(p) > 1 {
+		c.AbortWithStatus(404)
+		return
+	}
+	if p[0] != "" {
+		c.Set("filename", p[0])
+	}
+	r.parseFileLink(c, link)
+}
+
+func (r routerImpl) parseFileLink(c *gin.Context, link string) {
 	var g []string
-	for _, r := range web.FileLinkRegexs {
+	for _, r := range megalink.FileLinkRegexs {
 		g = r.FindStringSubmatch(link)
 		if len(g) > 0 {
 			break
@@ -46,99 +266,216 @@ func parseFileLink(c *gin.Context) {
 		c.AbortWithStatus(404)
 		return
 	}
+	if !r.allow(c, g[1]) {
+		return
+	}
 
-	info, err := megaClient.GetPublicFileNodeInfo(g[1], g[1], g[2])
+	info, err := r.opts.Client.GetPublicFileNodeInfoContext(c.Request.Context(), g[1], g[1], g[2])
 	if err != nil {
 		abortWithError(c, err)
 		return
 	}
-
-	if info.Attr.Name != "" {
-		c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+strings.ReplaceAll(url.QueryEscape(info.Attr.Name), "+", "%20"))
+	if !r.allowNode(c, info) {
+		return
 	}
 
+	setContentDisposition(c, info)
 	c.Set("info", info)
 	c.Next()
 }
 
-func parseFolderFileLink(c *gin.Context) {
-	link := c.Param("link")
-	handle := c.Param("handle")
-	if len(handle) != mega.HandleLen || !web.FolderLinkRegex.MatchString(link) {
+func (r routerImpl) parseFolderFileLink(c *gin.Context, link, handle string) {
+	if len(handle) != mega.HandleLen || !megalink.FolderLinkRegex.MatchString(link) {
 		c.AbortWithStatus(404)
 		return
 	}
 
 	g := strings.Split(link, "!")
-	fm, err := megaClient.OpenPublicFolder(g[0], g[1])
+	if !r.allow(c, g[0], handle) {
+		return
+	}
+	fm, err := r.opts.Client.OpenPublicFolderContext(c.Request.Context(), g[0], g[1])
 	if err != nil {
 		abortWithError(c, err)
 		return
 	}
 
 	node := fm.Lookup(handle)
-	if node == nil {
+	if node == nil || node.Type != mega.TypeFile {
 		c.AbortWithStatus(404)
 		return
 	}
+	r.serveFolderNode(c, fm, node)
+}
 
-	info, err := fm.GetFileNodeInfo(node)
+func (r routerImpl) serveFolderNode(c *gin.Context, fm *mega.FM, node *mega.Node) {
+	info, err := fm.GetFileNodeInfoContext(c.Request.Context(), node)
 	if err != nil {
 		abortWithError(c, err)
 		return
 	}
-
-	if info.Attr.Name != "" {
-		c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+strings.ReplaceAll(url.QueryEscape(info.Attr.Name), "+", "%20"))
+	if !r.allowNode(c, info) {
+		return
 	}
 
+	setContentDisposition(c, info)
 	c.Set("info", info)
 	c.Next()
 }
 
-func download(c *gin.Context) {
-	var err error
+// head is answered from node metadata only, no storage connection is opened
+func head(c *gin.Context) {
 	info := c.MustGet("info").(*mega.NodeInfo)
+	ranges, ok := evalRequest(c, info)
+	if !ok {
+		return
+	}
 
-	opt := mega.NewDownloadOption()
-	if r := c.GetHeader("Range"); r != "" {
-		g := rangeRegex.FindStringSubmatch(r)
-		if len(g) == 0 {
-			c.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
+	mimeType := contentType(info)
+	switch len(ranges) {
+	case 0:
+		c.Header("Content-Type", mimeType)
+		c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+		c.Status(http.StatusOK)
+	case 1:
+		c.Header("Content-Type", mimeType)
+		c.Header("Content-Range", ranges[0].contentRange(info.Size))
+		c.Header("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		c.Status(http.StatusPartialContent)
+	default:
+		boundary, size := multipartSize(ranges, mimeType, info.Size)
+		c.Header("Content-Type", "multipart/byteranges; boundary="+boundary)
+		c.Header("Content-Length", strconv.FormatInt(size, 10))
+		c.Status(http.StatusPartialContent)
+	}
+}
+
+// evalRequest sets the validators of info, then evaluates conditional and range headers,
+// ok is false when the response is already complete
+func evalRequest(c *gin.Context, info *mega.NodeInfo) (ranges []httpRange, ok bool) {
+	tag := etag(info)
+	c.Header("ETag", tag)
+	c.Header("Accept-Ranges", "bytes")
+	modTime := lastModified(info)
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.Format(http.TimeFormat))
+	}
 
-		s, _ := strconv.Atoi(g[1])
-		e := -1
-		if g[2] != "" {
-			e, _ = strconv.Atoi(g[2])
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		if etagMatch(inm, tag, true) {
+			c.Status(http.StatusNotModified)
+			return nil, false
+		}
+	} else if ims := c.GetHeader("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.After(t) {
+			c.Status(http.StatusNotModified)
+			return nil, false
 		}
-		opt = opt.Range(int64(s), int64(e))
 	}
 
-	for _, k := range []string{
-		"If-None-Match",
-		"If-Modified-Since",
-		"If-Range",
-		"User-Agent",
-	} {
-		if v := c.GetHeader(k); v != "" {
-			opt.HttpHeader(k, v)
+	ranges, err := requestRanges(c, info)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		c.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+		return nil, false
+	}
+	return ranges, true
+}
+
+// requestRanges evaluates Range and If-Range, nil ranges mean the whole content
+func requestRanges(c *gin.Context, info *mega.NodeInfo) ([]httpRange, error) {
+	rg := c.GetHeader("Range")
+	if ir := c.GetHeader("If-Range"); rg != "" && ir != "" && !ifRangeMatch(ir, etag(info), lastModified(info)) {
+		rg = ""
+	}
+	return parseRange(rg, info.Size)
+}
+
+func lastModified(info *mega.NodeInfo) time.Time {
+	if info.Timestamp > 0 {
+		return time.Unix(info.Timestamp, 0).UTC()
+	}
+	return time.Time{}
+}
+
+// setContentDisposition names the file after the URL filename if any, else the node name.
+// ?inline asks browsers to preview instead of saving
+func setContentDisposition(c *gin.Context, info *mega.NodeInfo) {
+	name := c.GetString("filename")
+	if name == "" {
+		name = info.Attr.Name
+	}
+
+	typ := "attachment"
+	if v, ok := c.GetQuery("inline"); ok && v != "0" && v != "false" {
+		typ = "inline"
+	}
+	if name == "" {
+		c.Header("Content-Disposition", typ)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`,
+		typ, asciiFilename(name), strings.ReplaceAll(url.QueryEscape(name), "+", "%20")))
+}
+
+// asciiFilename is the filename= fallback for clients without RFC 6266 filename* support,
+// path separators are replaced too so that no client saves outside its download directory
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' || r == '%' || r == '/' {
+			b.WriteByte('_')
+		} else {
+			b.WriteRune(r)
 		}
 	}
+	return b.String()
+}
+
+func contentType(info *mega.NodeInfo) string {
+	mimeType := mime.TypeByExtension(path.Ext(info.Attr.Name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType
+}
+
+func (r routerImpl) download(c *gin.Context) {
+	info := c.MustGet("info").(*mega.NodeInfo)
+	ranges, ok := evalRequest(c, info)
+	if !ok {
+		return
+	}
+
+	opt := mega.NewDownloadOption()
+	if v := c.GetHeader("User-Agent"); v != "" {
+		opt = opt.HttpHeader("User-Agent", v)
+	}
 
-	dl, err := megaClient.Download(info, opt)
+	mimeType := contentType(info)
+	if len(ranges) > 1 {
+		r.downloadMultipart(c, info, ranges, mimeType, opt)
+		return
+	}
+
+	var s, e int64 = 0, -1
+	if len(ranges) == 1 {
+		s, e = ranges[0].start, ranges[0].end()
+	}
+	dl, err := r.open(c.Request.Context(), info, s, e, len(ranges) == 1, opt)
 	if err != nil {
 		abortWithError(c, err)
 		return
 	}
 	defer dl.Close()
+	// a failed upstream open doesn't cost a use
+	if !r.useSignedLink(c, info, ranges) {
+		return
+	}
 
 	for _, k := range []string{
 		"Date",
-		"ETag",
 		"Expires",
-		"Last-Modified",
 	} {
 		if v := dl.Http.Header.Get(k); v != "" {
 			c.Header(k, v)
@@ -149,18 +486,87 @@ func download(c *gin.Context) {
 		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", dl.Range.S, dl.Range.E, dl.Range.Total))
 	}
 
-	mimeType := mime.TypeByExtension(path.Ext(info.Attr.Name))
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	c.DataFromReader(dl.Http.StatusCode, dl.Range.E-dl.Range.S+1, mimeType, dl, nil)
+}
+
+// downloadMultipart answers a multi-range request with a multipart/byteranges body,
+// every part is fetched from upstream in turn
+func (r routerImpl) downloadMultipart(c *gin.Context, info *mega.NodeInfo, ranges []httpRange, mimeType string, opt mega.DownloadOption) {
+	// open the first part up front, so upstream errors still get a proper status
+	first, err := r.open(c.Request.Context(), info, ranges[0].start, ranges[0].end(), true, opt)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !r.useSignedLink(c, info, ranges) {
+		first.Close()
+		return
 	}
 
-	c.DataFromReader(dl.Http.StatusCode, dl.Range.E-dl.Range.S+1, mimeType, dl, nil)
+	boundary, size := multipartSize(ranges, mimeType, info.Size)
+	c.Header("Content-Type", "multipart/byteranges; boundary="+boundary)
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusPartialContent)
+
+	mw := multipart.NewWriter(c.Writer)
+	_ = mw.SetBoundary(boundary)
+	for i, ra := range ranges {
+		dl := first
+		if i > 0 {
+			if dl, err = r.open(c.Request.Context(), info, ra.start, ra.end(), true, opt); err != nil {
+				_ = c.Error(err)
+				c.Abort()
+				return
+			}
+		}
+		part, err := mw.CreatePart(ra.mimeHeader(mimeType, info.Size))
+		if err == nil {
+			_, err = io.CopyN(part, dl, ra.length)
+		}
+		dl.Close()
+		if err != nil {
+			_ = c.Error(err)
+			c.Abort()
+			return
+		}
+	}
+	_ = mw.Close()
 }
 
-func abortWithError(c *gin.Context, err error) (code int) {
-	err, code, msg := web.ConvertError(err)
-	c.Abort()
-	c.Error(err)
-	c.String(code, msg)
+func (r routerImpl) open(ctx context.Context, info *mega.NodeInfo, s, e int64, ranged bool, opt mega.DownloadOption) (dl *mega.Download, err error) {
+	if r.opts.Segment.Enabled() && info.Size > 0 {
+		dl, err = r.opts.Client.DownloadSegmentedContext(ctx, info, s, e, r.opts.Segment, opt)
+	} else {
+		if ranged {
+			opt = opt.Range(s, e)
+		}
+		dl, err = r.opts.Client.DownloadContext(ctx, info, opt)
+	}
+	if err == nil && r.opts.Throttle != nil {
+		dl.SetLimiter(r.opts.Throttle.Conn(ctx))
+	}
 	return
 }
+
+// multipartSize picks a boundary and computes the length of the multipart/byteranges body
+func multipartSize(ranges []httpRange, mimeType string, size int64) (boundary string, n int64) {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	for _, ra := range ranges {
+		_, _ = mw.CreatePart(ra.mimeHeader(mimeType, size))
+		cw += countingWriter(ra.length)
+	}
+	_ = mw.Close()
+	return mw.Boundary(), int64(cw)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func abortWithError(c *gin.Context, err error) (code int) {
+	return web.AbortWithError(c, err)
+}
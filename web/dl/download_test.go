@@ -0,0 +1,403 @@
+package dl
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/linksign"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"github.com/mocukie/megalink/pkg/policy"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRouter serves a random file named file.bin modified at modTime, paths are its file link
+// and the same file inside a folder link
+func newTestRouter(t *testing.T, modTime time.Time) (r *gin.Engine, content []byte, paths []string) {
+	gin.SetMode(gin.TestMode)
+	content = make([]byte, 1000)
+	rand.Read(content)
+	client, link, folderLink := megatest.NewFileClient(megatest.File{Name: "file.bin", Content: content, ModTime: modTime})
+	r = gin.New()
+	NewRouter(Options{Client: client}).Setup(r)
+	return r, content, []string{"/dl/" + link, "/dl/" + folderLink + "/file/" + megatest.Handle}
+}
+
+func serve(r http.Handler, method, path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestHead(t *testing.T) {
+	modTime := time.Date(2020, 9, 23, 10, 12, 16, 0, time.UTC)
+	r, content, paths := newTestRouter(t, modTime)
+	for _, p := range paths {
+		w := serve(r, http.MethodHead, p)
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Fatalf("HEAD %s: got %d with %d bytes", p, w.Code, w.Body.Len())
+		}
+		for k, v := range map[string]string{
+			"Content-Length":      strconv.Itoa(len(content)),
+			"Content-Type":        "application/octet-stream",
+			"Accept-Ranges":       "bytes",
+			"Last-Modified":       "Wed, 23 Sep 2020 10:12:16 GMT",
+			"Content-Disposition": `attachment; filename="file.bin"; filename*=UTF-8''file.bin`,
+		} {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("HEAD %s: %s %q, want %q", p, k, got, v)
+			}
+		}
+		get := serve(r, http.MethodGet, p)
+		if tag := w.Header().Get("ETag"); tag == "" || tag != get.Header().Get("ETag") {
+			t.Errorf("HEAD %s: ETag %q, GET has %q", p, tag, get.Header().Get("ETag"))
+		}
+		if !bytes.Equal(get.Body.Bytes(), content) {
+			t.Errorf("GET %s: content mismatch", p)
+		}
+
+		w = serve(r, http.MethodHead, p, "Range", "bytes=10-19")
+		if w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != "bytes 10-19/1000" ||
+			w.Header().Get("Content-Length") != "10" {
+			t.Errorf("HEAD %s range: got %d %q %q", p, w.Code, w.Header().Get("Content-Range"), w.Header().Get("Content-Length"))
+		}
+		w = serve(r, http.MethodHead, p, "Range", "bytes=0-9,20-29")
+		get = serve(r, http.MethodGet, p, "Range", "bytes=0-9,20-29")
+		if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") ||
+			w.Header().Get("Content-Length") != strconv.Itoa(get.Body.Len()) {
+			t.Errorf("HEAD %s multi range: got %d %q length %q, GET sent %d bytes", p, w.Code,
+				w.Header().Get("Content-Type"), w.Header().Get("Content-Length"), get.Body.Len())
+		}
+		w = serve(r, http.MethodHead, p, "Range", "bytes=1000-")
+		if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */1000" {
+			t.Errorf("HEAD %s unsatisfiable range: got %d %q", p, w.Code, w.Header().Get("Content-Range"))
+		}
+	}
+
+	// without fingerprint the file link has no modification time
+	r, _, paths = newTestRouter(t, time.Time{})
+	if w := serve(r, http.MethodHead, paths[0]); w.Header().Get("Last-Modified") != "" {
+		t.Errorf("HEAD without fingerprint: Last-Modified %q", w.Header().Get("Last-Modified"))
+	}
+}
+
+func TestConditional(t *testing.T) {
+	modTime := time.Date(2020, 9, 23, 10, 12, 16, 0, time.UTC)
+	r, content, paths := newTestRouter(t, modTime)
+	tag := serve(r, http.MethodHead, paths[0]).Header().Get("ETag")
+	lastMod := modTime.Format(http.TimeFormat)
+	before := modTime.Add(-time.Second).Format(http.TimeFormat)
+	after := modTime.Add(time.Hour).Format(http.TimeFormat)
+
+	for _, c := range []struct {
+		header []string
+		code   int
+	}{
+		{nil, 200},
+		{[]string{"If-None-Match", tag}, 304},
+		{[]string{"If-None-Match", `"other", ` + tag}, 304},
+		{[]string{"If-None-Match", "W/" + tag}, 304},
+		{[]string{"If-None-Match", "*"}, 304},
+		{[]string{"If-None-Match", `"other"`}, 200},
+		{[]string{"If-Modified-Since", lastMod}, 304},
+		{[]string{"If-Modified-Since", after}, 304},
+		{[]string{"If-Modified-Since", before}, 200},
+		{[]string{"If-Modified-Since", "yesterday"}, 200},
+		// If-None-Match takes precedence over If-Modified-Since
+		{[]string{"If-None-Match", `"other"`, "If-Modified-Since", lastMod}, 200},
+	} {
+		for _, p := range paths {
+			for _, method := range []string{http.MethodHead, http.MethodGet} {
+				w := serve(r, method, p, c.header...)
+				if w.Code != c.code {
+					t.Errorf("%s %s %q: got %d, want %d", method, p, c.header, w.Code, c.code)
+					continue
+				}
+				if w.Code == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != tag) {
+					t.Errorf("%s %s %q: 304 with %d bytes, ETag %q", method, p, c.header, w.Body.Len(), w.Header().Get("ETag"))
+				}
+				if method == http.MethodGet && w.Code == http.StatusOK && !bytes.Equal(w.Body.Bytes(), content) {
+					t.Errorf("%s %s %q: content mismatch", method, p, c.header)
+				}
+			}
+		}
+	}
+
+	// no Last-Modified to compare with, If-Modified-Since is ignored
+	r, _, paths = newTestRouter(t, time.Time{})
+	if w := serve(r, http.MethodGet, paths[0], "If-Modified-Since", after); w.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since without fingerprint: got %d", w.Code)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	modTime := time.Date(2020, 9, 23, 10, 12, 16, 0, time.UTC)
+	r, content, paths := newTestRouter(t, modTime)
+	tag := serve(r, http.MethodHead, paths[0]).Header().Get("ETag")
+
+	for _, c := range []struct {
+		ifRange string
+		partial bool
+	}{
+		{"", true},
+		{tag, true},
+		{modTime.Format(http.TimeFormat), true},
+		{`"other"`, false},
+		{"W/" + tag, false},
+		{modTime.Add(-time.Second).Format(http.TimeFormat), false},
+		{modTime.Add(time.Second).Format(http.TimeFormat), false},
+		{"yesterday", false},
+	} {
+		for _, p := range paths {
+			header := []string{"Range", "bytes=100-199"}
+			if c.ifRange != "" {
+				header = append(header, "If-Range", c.ifRange)
+			}
+			w := serve(r, http.MethodGet, p, header...)
+			switch {
+			case c.partial && (w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[100:200])):
+				t.Errorf("GET %s If-Range %q: got %d with %d bytes, want the range", p, c.ifRange, w.Code, w.Body.Len())
+			case !c.partial && (w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content)):
+				t.Errorf("GET %s If-Range %q: got %d with %d bytes, want the full file", p, c.ifRange, w.Code, w.Body.Len())
+			}
+			if h := serve(r, http.MethodHead, p, header...); h.Code != w.Code {
+				t.Errorf("HEAD %s If-Range %q: got %d, GET %d", p, c.ifRange, h.Code, w.Code)
+			}
+		}
+	}
+}
+
+func TestAsciiFilename(t *testing.T) {
+	for _, c := range []struct {
+		name, want string
+	}{
+		{"file.bin", "file.bin"},
+		{"my file (1).txt", "my file (1).txt"},
+		{"résumé.pdf", "r_sum_.pdf"},
+		{"日本語.txt", "___.txt"},
+		{`say "hi".txt`, "say _hi_.txt"},
+		{`a\b.txt`, "a_b.txt"},
+		{"../a/b.txt", ".._a_b.txt"},
+		{"100%.txt", "100_.txt"},
+		{"tab\there\n.txt", "tab_here_.txt"},
+		{"del\x7f.txt", "del_.txt"},
+	} {
+		if got := asciiFilename(c.name); got != c.want {
+			t.Errorf("asciiFilename(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSetContentDisposition(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, c := range []struct {
+		filename, node, query, want string
+	}{
+		{"", "file.bin", "", `attachment; filename="file.bin"; filename*=UTF-8''file.bin`},
+		{"other.txt", "file.bin", "", `attachment; filename="other.txt"; filename*=UTF-8''other.txt`},
+		{"", "", "", "attachment"},
+		{"", "", "?inline", "inline"},
+		{"", "my file.txt", "", `attachment; filename="my file.txt"; filename*=UTF-8''my%20file.txt`},
+		{"", "résumé.pdf", "", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"", `say "hi".txt`, "", `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"", "a/b.txt", "", `attachment; filename="a_b.txt"; filename*=UTF-8''a%2Fb.txt`},
+		{"", "a+b;c.txt", "", `attachment; filename="a+b;c.txt"; filename*=UTF-8''a%2Bb%3Bc.txt`},
+		{"", "file.bin", "?inline", `inline; filename="file.bin"; filename*=UTF-8''file.bin`},
+		{"", "file.bin", "?inline=1", `inline; filename="file.bin"; filename*=UTF-8''file.bin`},
+		{"", "file.bin", "?inline=0", `attachment; filename="file.bin"; filename*=UTF-8''file.bin`},
+		{"", "file.bin", "?inline=false", `attachment; filename="file.bin"; filename*=UTF-8''file.bin`},
+	} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/"+c.query, nil)
+		if c.filename != "" {
+			ctx.Set("filename", c.filename)
+		}
+		info := &mega.NodeInfo{Attr: mega.Attribute{Name: c.node}}
+		setContentDisposition(ctx, info)
+		if got := w.Header().Get("Content-Disposition"); got != c.want {
+			t.Errorf("%q %q %q: got %s, want %s", c.filename, c.node, c.query, got, c.want)
+		}
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	r, _, paths := newTestRouter(t, time.Time{})
+	file, folder := paths[0], strings.TrimSuffix(paths[1], "/file/"+megatest.Handle)
+	const disposition = `attachment; filename="%s"; filename*=UTF-8''%s`
+	for _, c := range []struct {
+		path     string
+		code     int
+		filename string
+	}{
+		{file, 200, "file.bin"},
+		{file + "/", 200, "file.bin"},
+		{file + "/other.txt", 200, "other.txt"},
+		{file + "/r%C3%A9sum%C3%A9.pdf", 200, "résumé.pdf"},
+		{file + "/a%22b.txt", 200, `a"b.txt`},
+		{file + "/a/b.txt", 404, ""},
+		{file + "/a%2Fb.txt", 404, ""},
+		{"/dl/" + megatest.Handle, 404, ""},
+		{"/dl/" + megatest.Handle + "!short", 404, ""},
+		{"/dl/notalink", 404, ""},
+
+		{folder + "/file/" + megatest.Handle, 200, "file.bin"},
+		{folder + "/file/" + megatest.Handle + "/", 200, "file.bin"},
+		{folder + "/file/" + megatest.Handle + "/other.txt", 200, "other.txt"},
+		{folder + "/file/" + megatest.Handle + "/r%C3%A9sum%C3%A9.pdf", 200, "résumé.pdf"},
+		{folder + "/file/" + megatest.Handle + "/a/b.txt", 404, ""},
+		{folder, 404, ""},
+		{folder + "/", 404, ""},
+		{folder + "/file", 404, ""},
+		{folder + "/file/", 404, ""},
+		{folder + "/other.txt", 404, ""},
+		{folder + "/folder/" + megatest.Handle, 404, ""},
+		{folder + "/file/abc", 404, ""},
+		{folder + "/file/" + megatest.Handle + "x", 404, ""},
+		{folder + "/file/zzzzzzzz", 404, ""},
+		{folder + "/file/" + megatest.RootHandle, 404, ""},
+		{"/dl/zzzzzzzz!" + strings.SplitN(folder, "!", 2)[1] + "/file/" + megatest.Handle, 404, ""},
+	} {
+		w := serve(r, http.MethodHead, c.path)
+		if w.Code != c.code {
+			t.Errorf("HEAD %s: got %d, want %d", c.path, w.Code, c.code)
+			continue
+		}
+		if c.filename == "" {
+			continue
+		}
+		want := fmt.Sprintf(disposition, asciiFilename(c.filename), strings.ReplaceAll(url.QueryEscape(c.filename), "+", "%20"))
+		if got := w.Header().Get("Content-Disposition"); got != want {
+			t.Errorf("HEAD %s: Content-Disposition %s, want %s", c.path, got, want)
+		}
+	}
+}
+
+func TestSignedLinkUses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	client, link := megatest.NewClient("file.bin", make([]byte, 1000))
+	signer, err := linksign.NewSigner([]byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	NewRouter(Options{Client: client, Signer: signer, SignedOnly: true}).Setup(r)
+	issue := func(link string) (*linksign.Claims, string) {
+		claims := &linksign.Claims{Link: link, MaxUses: 1}
+		token, err := signer.Issue(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claims, "/s/" + token
+	}
+
+	// a GET sending the same bytes again takes the next use, whatever the range
+	for _, c := range []struct {
+		header []string
+		used   bool
+	}{
+		{nil, true},
+		{[]string{"Range", "bytes=0-"}, true},
+		{[]string{"Range", "bytes=00-"}, true},
+		{[]string{"Range", "bytes=0-0"}, true},
+		{[]string{"Range", "bytes=-99999999999"}, true},
+		{[]string{"Range", "bytes=-1000"}, true},
+		{[]string{"Range", "bytes=1-,0-0"}, true},
+		{[]string{"Range", "bytes=10-19, 0-9"}, true},
+		{[]string{"Range", "bytes=0-1000,0-1000"}, true},
+		{[]string{"Range", "bytes=1-"}, true},
+		{[]string{"Range", "bytes=10-19,500-"}, true},
+		{[]string{"Range", "bytes=-999"}, true},
+		// ignored, the whole file is sent
+		{[]string{"Range", "bytes=x-"}, true},
+		{[]string{"Range", "items=1-"}, true},
+		{[]string{"Range", "bytes=10-", "If-Range", `"other"`}, true},
+		// unsatisfiable, nothing is sent
+		{[]string{"Range", "bytes=1000-"}, false},
+	} {
+		_, path := issue(link)
+		if w := serve(r, http.MethodHead, path, c.header...); w.Code >= 400 && w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("HEAD %q: got %d", c.header, w.Code)
+		}
+		first := serve(r, http.MethodGet, path, c.header...)
+		second := serve(r, http.MethodGet, path, c.header...)
+		if first.Code >= 400 && first.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("GET %q: got %d", c.header, first.Code)
+		}
+		if used := second.Code != first.Code; used != c.used {
+			t.Errorf("GET %q: got %d then %d, use consumed %v, want %v", c.header, first.Code, second.Code, used, c.used)
+		}
+	}
+
+	// the connections of a segmented downloader share a use, the next copy needs another
+	_, path := issue(link)
+	for i, c := range []struct {
+		rg   string
+		code int
+	}{
+		{"bytes=1-", http.StatusPartialContent},
+		{"bytes=0-0", http.StatusPartialContent},
+		{"bytes=1-", http.StatusGone},
+		{"bytes=0-0", http.StatusGone},
+	} {
+		if w := serve(r, http.MethodGet, path, "Range", c.rg); w.Code != c.code {
+			t.Errorf("#%d %s: got %d, want %d", i, c.rg, w.Code, c.code)
+		}
+	}
+
+	// a failed upstream open costs no use
+	down, downLink, _ := megatest.NewFileClient(megatest.File{Name: "file.bin", Content: make([]byte, 1000), StorageStatus: 509})
+	r = gin.New()
+	NewRouter(Options{Client: down, Signer: signer, SignedOnly: true}).Setup(r)
+	claims, path := issue(downLink)
+	if w := serve(r, http.MethodGet, path); w.Code < 400 {
+		t.Fatalf("GET from failing storage: got %d", w.Code)
+	}
+	if err = signer.Use(claims, []linksign.Span{{Start: 0, End: 1000}}, time.Now()); err != nil {
+		t.Errorf("use after failed open: %v", err)
+	}
+}
+
+func TestAliasPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, _, folderLink := megatest.NewFileClient(megatest.File{Name: "file.bin", Content: make([]byte, 10)})
+	aliases, err := alias.Open(filepath.Join(t.TempDir(), "aliases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = aliases.Set(alias.Entry{Name: "team", Link: folderLink}); err != nil {
+		t.Fatal(err)
+	}
+	pol, err := policy.New(policy.Rules{Handles: policy.List{Deny: []string{megatest.FolderHandle}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := mega.NewClient(&http.Client{Transport: megatest.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("MEGA request %s for a denied folder", req.URL)
+		return nil, fmt.Errorf("denied")
+	})})
+	r := gin.New()
+	NewRouter(Options{Client: client, Aliases: aliases, Policy: pol}).Setup(r)
+
+	// existing and missing paths look the same
+	for _, p := range []string{"/a/team/file.bin", "/a/team/missing.bin"} {
+		for _, method := range []string{http.MethodHead, http.MethodGet} {
+			if w := serve(r, method, p); w.Code != http.StatusForbidden {
+				t.Errorf("%s %s: got %d, want 403", method, p, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mocukie/megalink/pkg/mega"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges bounds the parts of a multipart/byteranges response, every part opens its own upstream
+// stream, requests asking for more after coalescing get the whole content (RFC 7233 section 6.1)
+const maxRanges = 16
+
+var (
+	errNoOverlap = errors.New("range does not overlap content")
+)
+
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) end() int64 {
+	return r.start + r.length - 1
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end(), size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header (RFC 7233 section 2.1) against a content of the given size,
+// a nil result with nil error means the header should be ignored and the whole content served,
+// which is also the case of other units and invalid syntax (section 3.1).
+// Overlapping and adjacent ranges are coalesced, the result is sorted.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, nil
+	}
+
+	var ranges []httpRange
+	var noOverlap bool
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, nil
+		}
+		start, end := textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
+
+		var r httpRange
+		if start == "" {
+			// suffix range, the last n bytes
+			if end == "" || end[0] == '-' {
+				return nil, nil
+			}
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start, r.length = size-n, n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, nil
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - i
+			} else {
+				j, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || i > j {
+					return nil, nil
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.length = j - i + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errNoOverlap
+		}
+		return nil, nil
+	}
+
+	// asking for more than the content itself is cheaper to serve as a whole
+	var sum int64
+	for _, r := range ranges {
+		sum += r.length
+	}
+	if sum > size {
+		return nil, nil
+	}
+	if ranges = coalesce(ranges); len(ranges) > maxRanges {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// coalesce sorts ranges and joins the overlapping and adjacent ones, in place
+func coalesce(ranges []httpRange) []httpRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start > last.end()+1 {
+			merged = append(merged, r)
+		} else if r.end() > last.end() {
+			last.length = r.end() - last.start + 1
+		}
+	}
+	return merged
+}
+
+// etag is a strong validator of the decrypted content, the node MAC changes whenever the content does
+func etag(info *mega.NodeInfo) string {
+	return fmt.Sprintf(`"%s-%x"`, info.Handle, info.K.Mac)
+}
+
+// ifRangeMatch evaluates If-Range, which holds either a strong entity tag or an HTTP date
+func ifRangeMatch(header, tag string, modTime time.Time) bool {
+	if strings.HasPrefix(header, `"`) {
+		return header == tag
+	}
+	t, err := http.ParseTime(header)
+	return err == nil && !modTime.IsZero() && t.Equal(modTime)
+}
+
+// etagMatch reports whether the If-None-Match style header list contains tag,
+// weak comparison ignores the W/ prefix
+func etagMatch(header, tag string, weak bool) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = textproto.TrimString(v)
+		if v == "*" {
+			return true
+		}
+		if strings.HasPrefix(v, "W/") {
+			if !weak {
+				continue
+			}
+			v = v[2:]
+		}
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
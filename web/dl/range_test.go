@@ -0,0 +1,96 @@
+package dl
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		size   int64
+		want   []httpRange
+		err    error
+	}{
+		{"bytes=0-", 100, []httpRange{{0, 100}}, nil},
+		{"bytes=10-19", 100, []httpRange{{10, 10}}, nil},
+		{"bytes=90-200", 100, []httpRange{{90, 10}}, nil},
+		{"bytes=-10", 100, []httpRange{{90, 10}}, nil},
+		{"bytes=-200", 100, []httpRange{{0, 100}}, nil},
+		{"bytes=0-9, 20-29,-5", 100, []httpRange{{0, 10}, {20, 10}, {95, 5}}, nil},
+		{"bytes=0-99,0-99", 100, nil, nil},
+		{"bytes=100-", 100, nil, errNoOverlap},
+		{"bytes=-0", 100, nil, errNoOverlap},
+		{"bytes=200-300,50-60", 100, []httpRange{{50, 11}}, nil},
+		{"bytes=20-10", 100, nil, nil},
+		{"bytes=a-", 100, nil, nil},
+		{"bytes=--5", 100, nil, nil},
+		{"items=0-1", 100, nil, nil},
+		{"bytes=", 100, nil, nil},
+		// coalesced
+		{"bytes=20-29,0-9", 100, []httpRange{{0, 10}, {20, 10}}, nil},
+		{"bytes=0-9,10-19,5-14", 100, []httpRange{{0, 20}}, nil},
+		{"bytes=10-19,0-49", 100, []httpRange{{0, 50}}, nil},
+		{"bytes=0-0,2-2,4-4,6-6,8-8,10-10,12-12,14-14,16-16,18-18,20-20,22-22,24-24,26-26,28-28,30-30", 100,
+			[]httpRange{{0, 1}, {2, 1}, {4, 1}, {6, 1}, {8, 1}, {10, 1}, {12, 1}, {14, 1}, {16, 1}, {18, 1}, {20, 1}, {22, 1}, {24, 1}, {26, 1}, {28, 1}, {30, 1}}, nil},
+		// more than maxRanges after coalescing, the whole content is served
+		{"bytes=0-0,2-2,4-4,6-6,8-8,10-10,12-12,14-14,16-16,18-18,20-20,22-22,24-24,26-26,28-28,30-30,32-32", 100, nil, nil},
+	} {
+		got, err := parseRange(c.header, c.size)
+		if err != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %v, %v, want %v, %v", c.header, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	const tag = `"abcdefgh-0102"`
+	for _, c := range []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{tag, false, true},
+		{`W/` + tag, false, false},
+		{`W/` + tag, true, true},
+		{`"x", ` + tag, true, true},
+		{`*`, true, true},
+		{`"x"`, true, false},
+	} {
+		if got := etagMatch(c.header, tag, c.weak); got != c.want {
+			t.Errorf("%q weak=%v: got %v", c.header, c.weak, got)
+		}
+	}
+}
+
+func TestRangeCap(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, ",%d-%d", 2*i, 2*i)
+	}
+	if got, err := parseRange("bytes="+b.String()[1:], 100000); got != nil || err != nil {
+		t.Errorf("%d ranges: got %d ranges, %v, want the whole content", 5000, len(got), err)
+	}
+
+	// adjacent ranges, e.g. of a misbehaving downloader, are a single one
+	b.Reset()
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, ",%d-%d", i, i)
+	}
+	if got, err := parseRange("bytes="+b.String()[1:], 100000); err != nil || !reflect.DeepEqual(got, []httpRange{{0, 5000}}) {
+		t.Errorf("adjacent ranges: got %v, %v", got, err)
+	}
+
+	r, _, paths := newTestRouter(t, time.Time{})
+	b.Reset()
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, ",%d-%d", 2*i, 2*i)
+	}
+	if w := serve(r, http.MethodGet, paths[0], "Range", "bytes="+b.String()[1:]); w.Code != http.StatusOK || w.Body.Len() != 1000 {
+		t.Errorf("100 ranges: got %d with %d bytes, want the whole file", w.Code, w.Body.Len())
+	}
+}
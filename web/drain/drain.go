@@ -0,0 +1,95 @@
+package drain
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/web/accesslog"
+	"sync"
+)
+
+// Tracker keeps count of the downloads in flight, so that a shutdown can wait for them
+// and cancel those which outlast it
+type Tracker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	active int
+	idle   chan struct{} // closed when active drops to 0
+}
+
+func New() *Tracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	idle := make(chan struct{})
+	close(idle)
+	return &Tracker{ctx: ctx, cancel: cancel, idle: idle}
+}
+
+func (t *Tracker) begin() {
+	t.mu.Lock()
+	if t.active == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.active++
+	t.mu.Unlock()
+}
+
+func (t *Tracker) end() {
+	t.mu.Lock()
+	t.active--
+	if t.active == 0 {
+		close(t.idle)
+	}
+	t.mu.Unlock()
+}
+
+// Transfer tracks a download and cancels its request context on Cancel,
+// it must wrap the download handler
+func (t *Tracker) Transfer(c *gin.Context) {
+	t.begin()
+	defer t.end()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	if t.ctx.Err() != nil && ctx.Err() != nil {
+		accesslog.Entry(c).WithField("bytes", c.Writer.Size()).Warn("transfer interrupted by shutdown")
+	}
+}
+
+// Active returns the number of downloads in flight
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Wait blocks until no download is in flight or ctx is done
+func (t *Tracker) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cancel cancels the downloads in flight and any started later, it returns how many were in flight
+func (t *Tracker) Cancel() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancel()
+	return t.active
+}
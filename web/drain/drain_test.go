@@ -0,0 +1,70 @@
+package drain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDrain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tr := New()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	e := gin.New()
+	e.GET("/short", tr.Transfer, func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	e.GET("/long", tr.Transfer, func(c *gin.Context) {
+		started <- struct{}{}
+		<-c.Request.Context().Done()
+		c.Status(http.StatusServiceUnavailable)
+	})
+
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Fatalf("idle wait: %v", err)
+	}
+
+	done := make(chan int, 2)
+	for _, path := range []string{"/short", "/long"} {
+		go func(path string) {
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			done <- w.Code
+		}(path)
+		<-started
+	}
+	if n := tr.Active(); n != 2 {
+		t.Fatalf("active %d, want 2", n)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("short transfer: got %d", code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tr.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait: got %v, want deadline exceeded", err)
+	}
+
+	if n := tr.Cancel(); n != 1 {
+		t.Fatalf("cancelled %d, want 1", n)
+	}
+	if code := <-done; code != http.StatusServiceUnavailable {
+		t.Fatalf("long transfer: got %d", code)
+	}
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Fatalf("wait after cancel: %v", err)
+	}
+	if n := tr.Active(); n != 0 {
+		t.Fatalf("active %d after drain", n)
+	}
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/web"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL     = 10 * time.Second
+	DefaultTimeout = 5 * time.Second
+)
+
+type Options struct {
+	// MEGA client whose api must answer for /readyz, default web.MegaClient
+	Client *mega.Client
+	// how long a readiness result is reused, so that probes don't load the api, default DefaultTTL
+	TTL time.Duration
+	// bound of a readiness check, default DefaultTimeout
+	Timeout time.Duration
+}
+
+type routerImpl struct {
+	opts Options
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// NewRouter serves /healthz, which answers as long as the process serves requests, and /readyz,
+// which also needs the MEGA api to be reachable
+func NewRouter(opts Options) web.IRouter {
+	if opts.Client == nil {
+		opts.Client = web.MegaClient
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	return &routerImpl{opts: opts}
+}
+
+func (r *routerImpl) Setup(g gin.IRouter) {
+	g.GET("/healthz", healthz)
+	g.HEAD("/healthz", healthz)
+	g.GET("/readyz", r.readyz)
+	g.HEAD("/readyz", r.readyz)
+}
+
+func healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+func (r *routerImpl) readyz(c *gin.Context) {
+	if err := r.ready(); err != nil {
+		c.Error(err)
+		c.String(http.StatusServiceUnavailable, "MEGA api unreachable")
+		return
+	}
+	c.String(http.StatusOK, "ok")
+}
+
+// ready returns the cached result of the last check, probes arriving during a check wait for it
+func (r *routerImpl) ready() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.checked.IsZero() && time.Since(r.checked) < r.opts.TTL {
+		return r.err
+	}
+	// detached from the probe, a probe giving up must not fail the cached result
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+	r.err = r.opts.Client.PingContext(ctx)
+	r.checked = time.Now()
+	return r.err
+}
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/mega/megatest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var calls int32
+	var down atomic.Value
+	down.Store(false)
+	client := mega.NewClient(&http.Client{Transport: megatest.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		if down.Load().(bool) {
+			return nil, errors.New("connection refused")
+		}
+		// an over quota answer still means the api is reachable
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("[-17]")), Request: req}, nil
+	})})
+
+	e := gin.New()
+	NewRouter(Options{Client: client, TTL: 50 * time.Millisecond}).Setup(e)
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := get("/readyz"); code != 200 {
+		t.Fatalf("reachable api: got %d", code)
+	}
+	down.Store(true)
+	if code := get("/readyz"); code != 200 || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("cached result: got %d after %d checks", code, calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("unreachable api: got %d", code)
+	}
+	if code := get("/healthz"); code != 200 {
+		t.Errorf("healthz: got %d", code)
+	}
+}
@@ -5,25 +5,31 @@ import (
 	"encoding/base64"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/alias"
+	"github.com/mocukie/megalink/pkg/apikey"
 	"github.com/mocukie/megalink/pkg/errutil"
+	"github.com/mocukie/megalink/pkg/linksign"
 	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/pkg/policy"
 	"net/http"
-	"regexp"
 )
 
-var (
-	FileLinkRegexs = []*regexp.Regexp{
-		regexp.MustCompile(`^!!([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{43})$`),
-		regexp.MustCompile(`^([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{43})$`),
-	}
-	FolderLinkRegex = regexp.MustCompile(`^([a-zA-Z\d_-]{8})!([a-zA-Z\d_-]{22})$`)
-	MegaClient      = mega.NewClient(http.DefaultClient)
-)
+var MegaClient = mega.NewClient(http.DefaultClient)
 
 type IRouter interface {
 	Setup(group gin.IRouter)
 }
 
+// StatusError is an error answered with its own status code, its message is public
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
 type errDetail struct {
 	Err error
 }
@@ -65,6 +71,10 @@ func ConvertError(err error) (parsedErr *gin.Error, code int, msg string) {
 		}
 		typ = gin.ErrorTypePublic
 		msg = e.Error()
+	case *StatusError:
+		code = e.Code
+		typ = gin.ErrorTypePublic
+		msg = e.Msg
 	case base64.CorruptInputError, aes.KeySizeError:
 		code = 400
 	default:
@@ -73,6 +83,42 @@ func ConvertError(err error) (parsedErr *gin.Error, code int, msg string) {
 			code = 400
 			typ = gin.ErrorTypePublic
 			msg = mega.API_EKEY.Message()
+		case policy.ErrDenied:
+			code = 403
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case alias.ErrNotFound:
+			code = 404
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case alias.ErrInvalidName:
+			code = 400
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case linksign.ErrInvalidToken:
+			code = 404
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case linksign.ErrExpired, linksign.ErrUsedUp:
+			code = 410
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case apikey.ErrNotFound:
+			code = 404
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case apikey.ErrDailyQuota, apikey.ErrMonthlyQuota, apikey.ErrTooManyStreams:
+			code = 429
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case apikey.ErrScope:
+			code = 403
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
+		case linksign.ErrIPMismatch:
+			code = 403
+			typ = gin.ErrorTypePublic
+			msg = cause.Error()
 		}
 	}
 
@@ -83,3 +129,12 @@ func ConvertError(err error) (parsedErr *gin.Error, code int, msg string) {
 	}
 	return
 }
+
+// AbortWithError aborts with the status and public message of err
+func AbortWithError(c *gin.Context, err error) (code int) {
+	err, code, msg := ConvertError(err)
+	c.Abort()
+	c.Error(err)
+	c.String(code, msg)
+	return
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/errutil"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	namespace = "megalink"
+	// MEGA storage servers answer 509 when the bandwidth quota of the client IP is used up
+	statusBandwidthExceeded = 509
+)
+
+// Metrics holds the collectors on a private registry, so that only megalink metrics,
+// plus the go runtime and process ones, are exported
+type Metrics struct {
+	registry *prometheus.Registry
+
+	apiCalls    *prometheus.CounterVec
+	apiDuration *prometheus.HistogramVec
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	transfers *prometheus.CounterVec
+	streams   prometheus.Gauge
+	bytes     prometheus.Counter
+	firstByte prometheus.Histogram
+	quotaHits prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		apiCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mega_api_calls_total",
+			Help:      "MEGA api requests by command and result code, 0 for success.",
+		}, []string{"command", "code"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "mega_api_duration_seconds",
+			Help:      "Latency of MEGA api requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"command"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP responses by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route, downloads last until the body is sent.",
+			Buckets:   []float64{.005, .025, .1, .5, 1, 5, 30, 120, 600, 3600},
+		}, []string{"route", "method"}),
+		transfers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_transfers_total",
+			Help:      "Downloads by type, range or full.",
+		}, []string{"type"}),
+		streams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_active_streams",
+			Help:      "Downloads in flight.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_bytes_total",
+			Help:      "Decrypted bytes sent to clients.",
+		}),
+		firstByte: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_first_byte_seconds",
+			Help:      "Time from the start of a download to its first body byte.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		quotaHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_quota_exceeded_total",
+			Help:      "Downloads refused by MEGA storage servers with 509 bandwidth quota exceeded.",
+		}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.apiCalls, m.apiDuration,
+		m.httpRequests, m.httpDuration,
+		m.transfers, m.streams, m.bytes, m.firstByte, m.quotaHits,
+	)
+	return m
+}
+
+func resultCode(err error) string {
+	if err == nil {
+		return "0"
+	}
+	switch e := errutil.Cause(err).(type) {
+	case mega.ApiErr:
+		return strconv.Itoa(int(e))
+	case mega.HttpStatusErr:
+		return "http_" + strconv.Itoa(int(e))
+	default:
+		return "error"
+	}
+}
+
+// ObserveAPICall is a mega.APIHook
+func (m *Metrics) ObserveAPICall(cmd string, err error, elapsed time.Duration) {
+	m.apiCalls.WithLabelValues(cmd, resultCode(err)).Inc()
+	m.apiDuration.WithLabelValues(cmd).Observe(elapsed.Seconds())
+}
+
+// Middleware counts the responses of every route, it must be used before any router is set up
+func (m *Metrics) Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	m.httpRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+	m.httpDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+
+	quotaHit := c.Writer.Status() == statusBandwidthExceeded
+	for _, e := range c.Errors {
+		if errutil.Cause(e.Err) == mega.HttpStatusErr(statusBandwidthExceeded) {
+			quotaHit = true
+		}
+	}
+	if quotaHit {
+		m.quotaHits.Inc()
+	}
+}
+
+// firstByteWriter reports the time of the first body write
+type firstByteWriter struct {
+	gin.ResponseWriter
+	start   time.Time
+	written bool
+	observe func(time.Duration)
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	if !w.written && len(p) != 0 {
+		w.written = true
+		w.observe(time.Since(w.start))
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *firstByteWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Transfer tracks downloads, it must wrap the download handler
+func (m *Metrics) Transfer(c *gin.Context) {
+	typ := "full"
+	if c.GetHeader("Range") != "" {
+		typ = "range"
+	}
+	m.transfers.WithLabelValues(typ).Inc()
+	m.streams.Inc()
+	defer m.streams.Dec()
+
+	w := &firstByteWriter{ResponseWriter: c.Writer, start: time.Now(), observe: func(d time.Duration) {
+		m.firstByte.Observe(d.Seconds())
+	}}
+	c.Writer = w
+	c.Next()
+	if n := w.Size(); n > 0 {
+		m.bytes.Add(float64(n))
+	}
+}
+
+// Handler serves the metrics, token protects them with bearer auth unless empty
+func (m *Metrics) Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len("Bearer "):])), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="megalink metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
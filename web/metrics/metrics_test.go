@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/pkg/mega"
+	"github.com/mocukie/megalink/web"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := New()
+	e := gin.New()
+	e.Use(m.Middleware)
+	e.GET("/dl/:link", m.Transfer, func(c *gin.Context) {
+		c.String(200, "0123456789")
+	})
+	e.GET("/quota", func(c *gin.Context) {
+		web.AbortWithError(c, errorx.Decorate(mega.HttpStatusErr(509), "invalid http status"))
+	})
+	m.ObserveAPICall("g", errorx.Decorate(mega.API_ENOENT, ""), 30*time.Millisecond)
+	m.ObserveAPICall("f", nil, 10*time.Millisecond)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dl/x", nil),
+		httptest.NewRequest(http.MethodGet, "/quota", nil),
+	} {
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	rangeReq := httptest.NewRequest(http.MethodGet, "/dl/x", nil)
+	rangeReq.Header.Set("Range", "bytes=0-")
+	e.ServeHTTP(httptest.NewRecorder(), rangeReq)
+
+	h := m.Handler("s3cret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != 401 {
+		t.Errorf("without token: got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body := w.Body.String()
+	for _, want := range []string{
+		`megalink_mega_api_calls_total{code="-9",command="g"} 1`,
+		`megalink_mega_api_calls_total{code="0",command="f"} 1`,
+		`megalink_mega_api_duration_seconds_count{command="g"} 1`,
+		`megalink_http_requests_total{code="200",method="GET",route="/dl/:link"} 2`,
+		`megalink_http_requests_total{code="509",method="GET",route="/quota"} 1`,
+		`megalink_storage_transfers_total{type="full"} 1`,
+		`megalink_storage_transfers_total{type="range"} 1`,
+		`megalink_storage_bytes_total 20`,
+		`megalink_storage_active_streams 0`,
+		`megalink_storage_first_byte_seconds_count 2`,
+		`megalink_storage_quota_exceeded_total 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
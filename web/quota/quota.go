@@ -0,0 +1,46 @@
+package quota
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/auth"
+)
+
+// countingWriter accounts every byte written to the client, writes fail once a quota is used up
+type countingWriter struct {
+	gin.ResponseWriter
+	t *apikey.Transfer
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(p)
+	if aerr := w.t.Add(int64(n)); aerr != nil && err == nil {
+		err = aerr
+	}
+	return
+}
+
+func (w *countingWriter) WriteString(s string) (n int, err error) {
+	return w.Write([]byte(s))
+}
+
+// Transfer accounts downloads to the API key of the client, it must wrap the download handler,
+// requests of other clients pass through
+func Transfer(keys *apikey.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := auth.KeyID(c)
+		if id == "" {
+			c.Next()
+			return
+		}
+		t, err := keys.Begin(id)
+		if err != nil {
+			web.AbortWithError(c, err)
+			return
+		}
+		defer t.Done()
+		c.Writer = &countingWriter{ResponseWriter: c.Writer, t: t}
+		c.Next()
+	}
+}
@@ -0,0 +1,159 @@
+package quota
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/apikey"
+	"github.com/mocukie/megalink/pkg/errutil"
+	"github.com/mocukie/megalink/web/auth"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestServer serves /file, 4000 bytes in chunks of 500, /block, which sends a chunk and waits
+// for the client to go away, and /panic, which fails after a chunk
+func newTestServer(t *testing.T, keys *apikey.Store) (srv *httptest.Server, blocked chan struct{}) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(gin.RecoveryWithWriter(ioutil.Discard))
+	a, err := auth.NewRouter(auth.Config{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Setup(e)
+
+	chunk := make([]byte, 500)
+	blocked = make(chan struct{}, 1)
+	e.GET("/file", Transfer(keys), func(c *gin.Context) {
+		c.Header("Content-Length", "4000")
+		c.Status(http.StatusOK)
+		for i := 0; i < 8; i++ {
+			if _, err := c.Writer.Write(chunk); err != nil {
+				_ = c.Error(err)
+				return
+			}
+			c.Writer.Flush()
+		}
+	})
+	e.GET("/block", Transfer(keys), func(c *gin.Context) {
+		_, _ = c.Writer.Write(chunk)
+		c.Writer.Flush()
+		blocked <- struct{}{}
+		<-c.Request.Context().Done()
+	})
+	e.GET("/panic", Transfer(keys), func(c *gin.Context) {
+		_, _ = c.Writer.Write(chunk)
+		panic("download failed")
+	})
+	srv = httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv, blocked
+}
+
+func get(ctx context.Context, url, secret string) (code int, n int, err error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, len(body), err
+}
+
+func TestQuotaMidStream(t *testing.T) {
+	for _, c := range []struct {
+		limits apikey.Limits
+		err    error
+	}{
+		{apikey.Limits{Daily: 1000}, apikey.ErrDailyQuota},
+		{apikey.Limits{Monthly: 1000}, apikey.ErrMonthlyQuota},
+	} {
+		file := filepath.Join(t.TempDir(), "keys.json")
+		keys, err := apikey.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, secret, err := keys.Create("team", c.limits, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, _ := newTestServer(t, keys)
+
+		// the write going over the quota still reaches the client, the next one fails
+		code, n, err := get(context.Background(), srv.URL+"/file", secret)
+		if code != http.StatusOK || n != 1500 || err == nil {
+			t.Errorf("%+v: got %d with %d bytes, %v, want the body cut at 1500 bytes", c.limits, code, n, err)
+		}
+		if u := keys.Report()[k.ID]; u.DayBytes != 1500 || u.MonthBytes != 1500 || u.Streams != 0 {
+			t.Errorf("%+v: usage %+v", c.limits, u)
+		}
+		if code, _, _ = get(context.Background(), srv.URL+"/file", secret); code != http.StatusTooManyRequests {
+			t.Errorf("%+v: quota used up, got %d", c.limits, code)
+		}
+
+		// the usage is in memory until flushed, then it survives a restart
+		if err = keys.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := apikey.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = reopened.Begin(k.ID); errutil.Cause(err) != c.err {
+			t.Errorf("%+v: after restart got %v, want %v", c.limits, err, c.err)
+		}
+	}
+}
+
+func TestStreamReleased(t *testing.T) {
+	keys, err := apikey.Open(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, secret, err := keys.Create("team", apikey.Limits{MaxStreams: 1}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, blocked := newTestServer(t, keys)
+	released := func(what string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for keys.Report()[k.ID].Streams != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("stream not released after %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the client goes away mid-stream
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_, _, _ = get(ctx, srv.URL+"/block", secret)
+		close(done)
+	}()
+	<-blocked
+	if code, _, _ := get(context.Background(), srv.URL+"/file", secret); code != http.StatusTooManyRequests {
+		t.Errorf("second stream: got %d, want 429", code)
+	}
+	cancel()
+	<-done
+	released("client abort")
+
+	// the download handler fails
+	_, _, _ = get(context.Background(), srv.URL+"/panic", secret)
+	released("panic")
+
+	if code, n, err := get(context.Background(), srv.URL+"/file", secret); code != http.StatusOK || n != 4000 || err != nil {
+		t.Errorf("after release: got %d with %d bytes, %v", code, n, err)
+	}
+	if u := keys.Report()[k.ID]; u.Requests != 3 || u.TotalBytes != 5000 {
+		t.Errorf("usage %+v", u)
+	}
+}
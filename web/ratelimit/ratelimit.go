@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/auth"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idleTimeout      = 10 * time.Minute
+	streamRetryAfter = 5
+	janitorInterval  = time.Minute
+	clientKeyUser    = "user:"
+	clientKeyAddress = "ip:"
+)
+
+var (
+	ErrTooManyRequests = &web.StatusError{Code: http.StatusTooManyRequests, Msg: "too many requests"}
+	ErrTooManyStreams  = &web.StatusError{Code: http.StatusTooManyRequests, Msg: "too many concurrent downloads"}
+)
+
+type Config struct {
+	// MEGA link lookups per second of each client, 0 for unlimited
+	Rate  float64
+	Burst int
+	// simultaneous downloads of each client, 0 for unlimited
+	MaxStreams int
+}
+
+type client struct {
+	bucket  *rate.Limiter
+	streams int
+	seen    time.Time
+}
+
+// Limiter tracks clients by authenticated user (e.g. API token) or else by IP
+type Limiter struct {
+	conf Config
+
+	mu      sync.Mutex
+	clients map[string]*client
+	sweep   time.Time
+}
+
+func New(conf Config) *Limiter {
+	return &Limiter{
+		conf:    normalize(conf),
+		clients: make(map[string]*client),
+	}
+}
+
+func normalize(conf Config) Config {
+	if conf.Burst <= 0 {
+		conf.Burst = int(math.Max(1, math.Ceil(conf.Rate)))
+	}
+	return conf
+}
+
+func (c Config) limit() rate.Limit {
+	if c.Rate > 0 {
+		return rate.Limit(c.Rate)
+	}
+	return rate.Inf
+}
+
+func (l *Limiter) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conf.Rate > 0 || l.conf.MaxStreams > 0
+}
+
+// SetConfig replaces the limits, buckets of known clients are adjusted and downloads in flight go on
+func (l *Limiter) SetConfig(conf Config) {
+	conf = normalize(conf)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conf = conf
+	now := time.Now()
+	for _, cl := range l.clients {
+		cl.bucket.SetLimitAt(now, conf.limit())
+		cl.bucket.SetBurstAt(now, conf.Burst)
+	}
+}
+
+// ClientKey identifies the client a request is accounted to
+func ClientKey(c *gin.Context) string {
+	if u := auth.User(c); u != "" {
+		return clientKeyUser + u
+	}
+	return clientKeyAddress + web.ClientIP(c)
+}
+
+// get must be called with l.mu held
+func (l *Limiter) get(key string, now time.Time) *client {
+	if now.Sub(l.sweep) > janitorInterval {
+		l.sweep = now
+		for k, cl := range l.clients {
+			if cl.streams == 0 && now.Sub(cl.seen) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+	}
+
+	cl, ok := l.clients[key]
+	if !ok {
+		cl = &client{bucket: rate.NewLimiter(l.conf.limit(), l.conf.Burst)}
+		l.clients[key] = cl
+	}
+	cl.seen = now
+	return cl
+}
+
+// Lookup limits the rate of requests which query the MEGA api
+func (l *Limiter) Lookup(c *gin.Context) {
+	now := time.Now()
+	l.mu.Lock()
+	if l.conf.Rate <= 0 {
+		l.mu.Unlock()
+		c.Next()
+		return
+	}
+	r := l.get(ClientKey(c), now).bucket.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if delay > 0 {
+		r.CancelAt(now)
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		web.AbortWithError(c, errorx.Decorate(ErrTooManyRequests, ClientKey(c)))
+		return
+	}
+	c.Next()
+}
+
+// Stream limits the simultaneous downloads, it must wrap the download handler
+func (l *Limiter) Stream(c *gin.Context) {
+	key := ClientKey(c)
+	l.mu.Lock()
+	if l.conf.MaxStreams <= 0 {
+		l.mu.Unlock()
+		c.Next()
+		return
+	}
+	cl := l.get(key, time.Now())
+	if cl.streams >= l.conf.MaxStreams {
+		l.mu.Unlock()
+		c.Header("Retry-After", strconv.Itoa(streamRetryAfter))
+		web.AbortWithError(c, errorx.Decorate(ErrTooManyStreams, key))
+		return
+	}
+	cl.streams++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		cl.streams--
+		cl.seen = time.Now()
+		l.mu.Unlock()
+	}()
+	c.Next()
+}
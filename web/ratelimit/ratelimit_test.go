@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/netutil"
+	"github.com/mocukie/megalink/web"
+)
+
+func do(e *gin.Engine, path, remote, xff string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remote
+	if xff != "" {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w
+}
+
+func TestLookup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	trusted, _ := netutil.ParseNets([]string{"10.0.0.1"})
+	l := New(Config{Rate: 0.001, Burst: 2})
+	e := gin.New()
+	e.Use(web.RealIP(trusted, true))
+	e.GET("/", l.Lookup, func(c *gin.Context) {
+		c.String(200, web.ClientIP(c))
+	})
+
+	for i, tc := range []struct {
+		remote, xff string
+		code        int
+		ip          string
+	}{
+		{"192.0.2.1:1000", "", 200, "192.0.2.1"},
+		{"192.0.2.1:1001", "", 200, "192.0.2.1"},
+		{"192.0.2.1:1002", "", 429, ""},
+		// spoofed header from an untrusted peer is ignored
+		{"192.0.2.1:1003", "198.51.100.1", 429, ""},
+		// the proxy forwards distinct clients
+		{"10.0.0.1:1000", "192.0.2.1, 198.51.100.2", 200, "198.51.100.2"},
+		{"10.0.0.1:1001", "198.51.100.3, 10.0.0.1", 200, "198.51.100.3"},
+		// a proxy on a unix socket
+		{"@", "198.51.100.4", 200, "198.51.100.4"},
+	} {
+		w := do(e, "/", tc.remote, tc.xff)
+		if w.Code != tc.code {
+			t.Errorf("#%d: got %d, want %d", i, w.Code, tc.code)
+			continue
+		}
+		if tc.code == 429 && w.Header().Get("Retry-After") == "" {
+			t.Errorf("#%d: missing Retry-After", i)
+		}
+		if tc.code == 200 && w.Body.String() != tc.ip {
+			t.Errorf("#%d: client ip %q, want %q", i, w.Body.String(), tc.ip)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := New(Config{MaxStreams: 1})
+	e := gin.New()
+	var inner *httptest.ResponseRecorder
+	e.GET("/", l.Stream, func(c *gin.Context) {
+		if inner == nil {
+			// a second download while the first is still streaming
+			inner = do(e, "/", c.Request.RemoteAddr, "")
+		}
+		c.Status(200)
+	})
+
+	if w := do(e, "/", "192.0.2.1:1000", ""); w.Code != 200 {
+		t.Fatalf("first stream: got %d", w.Code)
+	}
+	if inner.Code != 429 || inner.Header().Get("Retry-After") == "" {
+		t.Errorf("concurrent stream: got %d %v", inner.Code, inner.Header())
+	}
+	if w := do(e, "/", "192.0.2.1:1000", ""); w.Code != 200 {
+		t.Errorf("stream after release: got %d", w.Code)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := New(Config{Rate: 0.001, Burst: 1})
+	e := gin.New()
+	e.GET("/", l.Lookup, func(c *gin.Context) {
+		c.Status(200)
+	})
+
+	if w := do(e, "/", "192.0.2.1:1000", ""); w.Code != 200 {
+		t.Fatalf("first lookup: got %d", w.Code)
+	}
+	if w := do(e, "/", "192.0.2.1:1000", ""); w.Code != 429 {
+		t.Fatalf("second lookup: got %d", w.Code)
+	}
+
+	l.SetConfig(Config{Rate: 1000, Burst: 10})
+	// the bucket refills at the new rate from now on
+	time.Sleep(10 * time.Millisecond)
+	if w := do(e, "/", "192.0.2.1:1000", ""); w.Code != 200 {
+		t.Errorf("lookup after raising the rate: got %d", w.Code)
+	}
+
+	l.SetConfig(Config{})
+	if l.Enabled() {
+		t.Error("limiter enabled without limits")
+	}
+	for i := 0; i < 20; i++ {
+		if w := do(e, "/", "192.0.2.1:1000", ""); w.Code != 200 {
+			t.Fatalf("unlimited lookup #%d: got %d", i, w.Code)
+		}
+	}
+}
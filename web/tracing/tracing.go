@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/mocukie/megalink/pkg/logging"
+	"github.com/mocukie/megalink/web"
+	"github.com/mocukie/megalink/web/accesslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/mocukie/megalink/web")
+
+// Middleware starts a server span per request, continuing a W3C traceparent sent by the client,
+// MEGA api and storage spans become its children through the request context
+func Middleware(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer.Start(ctx, "HTTP "+c.Request.Method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(c.Request.Method),
+			semconv.HTTPTargetKey.String(logging.Redact(c.Request.URL.RequestURI())),
+			semconv.HTTPClientIPKey.String(web.ClientIP(c)),
+		))
+	defer span.End()
+	if id := accesslog.RequestID(c); id != "" {
+		span.SetAttributes(attribute.String("megalink.request_id", id))
+	}
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	if route := c.FullPath(); route != "" {
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRouteKey.String(route))
+	}
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(status))
+	if n := c.Writer.Size(); n > 0 {
+		span.SetAttributes(attribute.Int("http.response_content_length", n))
+	}
+	for _, e := range c.Errors {
+		span.RecordError(errors.New(logging.Redact(e.Error())))
+	}
+}
@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	e := gin.New()
+	e.Use(Middleware)
+	e.GET("/dl/:link", func(c *gin.Context) {
+		_, span := otel.Tracer("test").Start(c.Request.Context(), "child")
+		span.End()
+		c.Status(200)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/dl/abcdefgh!0123456789012345678901", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.Name() != "GET /dl/:link" {
+		t.Errorf("server span name %q", server.Name())
+	}
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("traceparent not continued: %v, parent %v", server.SpanContext().TraceID(), server.Parent().SpanID())
+	}
+	if child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("handler span is not a child of the server span")
+	}
+	for _, kv := range server.Attributes() {
+		if kv.Key == semconv.HTTPTargetKey && kv.Value.AsString() != "/dl/abcdefgh!REDACTED" {
+			t.Errorf("target not redacted: %s", kv.Value.AsString())
+		}
+	}
+}